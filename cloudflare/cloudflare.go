@@ -1,95 +1,526 @@
 package cloudflare
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/kerti/cloudflare-ddns/config"
+	"github.com/kerti/cloudflare-ddns/host"
 	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/provider"
 	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
 )
 
+// requiredPermissions lists the zone permissions an API token must be granted
+var requiredPermissions = []string{
+	"#dns_records:read",
+	"#dns_records:edit",
+}
+
 // CheckConfig checks the cloudflare configuration
 func CheckConfig() error {
+	listID := viper.GetString("cloudflare.ipList.listID")
+	follow := viper.GetBool("cloudflare.follow.enabled")
+	if len(viper.GetStringSlice("cloudflare.hostnames")) == 0 && len(listID) == 0 && !follow {
+		logger.Debug("[CLOUDFLARE] No hostnames configured, Cloudflare not in use.")
+		return nil
+	}
+
 	email := viper.GetString("cloudflare.email")
 	apiKey := viper.GetString("cloudflare.apiKey")
-	zoneID := viper.GetString("cloudflare.zoneID")
-	if len(email) == 0 || len(apiKey) == 0 || len(zoneID) == 0 {
+	apiToken := viper.GetString("cloudflare.apiToken")
+	hasKey := len(email) > 0 && len(apiKey) > 0
+	if !hasKey && len(apiToken) == 0 {
 		return fmt.Errorf("Cloudflare is not properly set up, check your config file")
 	}
+	if hasKey && len(apiToken) > 0 {
+		logger.Warn("[CLOUDFLARE] Both an API token and a global API key are configured, using the API token.")
+	}
+	if len(listID) > 0 && len(viper.GetString("cloudflare.ipList.accountID")) == 0 {
+		return fmt.Errorf("Cloudflare IP List requires an account ID, check your config file")
+	}
 	logger.Debug("[CLOUDFLARE] Cloudflare configuration OK.")
 	return nil
 }
 
 // Cloudflare is the cloudflare client
 type Cloudflare struct {
-	cf     *cf.API
-	zoneID string
+	cf          *cf.API
+	transport   *retryTransport
+	zoneID      string
+	hostnames   []string
+	followZones []string
+	zonesLock   sync.Mutex
+	zones       map[string]string
+	zoneNames   map[string]string
 }
 
-// New instantiates a new cloudflare client
-func New() (*Cloudflare, error) {
+// New instantiates a new cloudflare client for the given hosts
+func New(hosts []host.Host) (*Cloudflare, error) {
 	email := viper.GetString("cloudflare.email")
 	apiKey := viper.GetString("cloudflare.apiKey")
+	apiToken := viper.GetString("cloudflare.apiToken")
 	zoneID := viper.GetString("cloudflare.zoneID")
 
-	api, err := cf.New(apiKey, email)
+	base, err := newBaseTransport(viper.GetString("cloudflare.caBundle"))
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	transport := newRetryTransport(base)
+	api, err := newAPI(apiKey, email, apiToken, transport)
 	if err != nil {
 		logger.Error(err.Error())
 		return nil, err
 	}
 
-	return &Cloudflare{
-		cf:     api,
-		zoneID: zoneID,
-	}, nil
+	c := &Cloudflare{
+		cf:        api,
+		transport: transport,
+		zoneID:    zoneID,
+		hostnames: make([]string, 0),
+		zones:     make(map[string]string),
+		zoneNames: make(map[string]string),
+	}
+
+	for _, h := range hosts {
+		c.hostnames = append(c.hostnames, h.Name)
+		if len(h.ZoneID) > 0 {
+			c.zones[h.Name] = h.ZoneID
+		}
+	}
+
+	if viper.GetBool("cloudflare.follow.enabled") {
+		c.followZones = viper.GetStringSlice("cloudflare.follow.zones")
+		if len(c.followZones) == 0 && len(zoneID) > 0 {
+			c.followZones = []string{zoneID}
+		}
+	}
+
+	return c, nil
 }
 
-// FetchA fetches an A-record
-func (c *Cloudflare) FetchA(host string) (result map[string]cf.DNSRecord, err error) {
-	logger.Debug("[CLOUDFLARE] Fetching A record for host [%v]", host)
-	records, err := c.cf.DNSRecords(c.zoneID, cf.DNSRecord{Name: host, Type: "A"})
+// newBaseTransport returns the default transport, or a copy of it trusting the
+// given CA bundle instead of the system roots, e.g. that of a TLS-intercepting
+// proxy
+func newBaseTransport(caBundle string) (http.RoundTripper, error) {
+	if len(caBundle) == 0 {
+		return http.DefaultTransport, nil
+	}
+
+	pool, err := config.CertPool(caBundle)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the Cloudflare CA bundle: %s", err.Error())
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return transport, nil
+}
+
+// newAPI constructs the API client on top of the retry transport, which takes
+// over the retries and rate limiting the client would otherwise do itself
+func newAPI(apiKey string, email string, apiToken string, transport *retryTransport) (*cf.API, error) {
+	opts := []cf.Option{
+		cf.HTTPClient(&http.Client{Transport: transport}),
+		cf.UsingRetryPolicy(0, 0, 0),
+		cf.UsingRateLimit(float64(rate.Inf)),
+	}
+
+	if len(apiToken) > 0 {
+		return cf.NewWithAPIToken(apiToken, opts...)
+	}
+	return cf.New(apiKey, email, opts...)
+}
+
+// Stats returns the API call statistics so far
+func (c *Cloudflare) Stats() provider.Stats {
+	return c.transport.Stats()
+}
+
+// zoneFor finds the ID of the zone a host belongs to, either from the host's
+// explicit override, or by looking up the longest matching zone name. Lookups
+// are serialized, so that hosts of the same zone discover it only once.
+func (c *Cloudflare) zoneFor(name string) (string, error) {
+	c.zonesLock.Lock()
+	defer c.zonesLock.Unlock()
+
+	if zoneID, ok := c.zones[name]; ok {
+		return zoneID, nil
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		zoneID, err := c.zoneIDByName(strings.Join(labels[i:], "."))
+		if err != nil {
+			logger.Debug(err.Error())
+			return "", err
+		}
+		if len(zoneID) > 0 {
+			logger.Debug("[CLOUDFLARE] Host [%s] belongs to zone [%s]", name, zoneID)
+			c.zones[name] = zoneID
+			return zoneID, nil
+		}
+	}
+
+	if len(c.zoneID) > 0 {
+		c.zones[name] = c.zoneID
+		return c.zoneID, nil
+	}
+
+	err := fmt.Errorf("no zone found for host [%s]", name)
+	logger.Debug(err.Error())
+	return "", err
+}
+
+func (c *Cloudflare) zoneIDByName(zoneName string) (string, error) {
+	if zoneID, ok := c.zoneNames[zoneName]; ok {
+		return zoneID, nil
+	}
+
+	zones, err := c.cf.ListZones(zoneName)
+	if err != nil {
+		return "", err
+	}
+
+	zoneID := ""
+	for _, z := range zones {
+		if z.Name == zoneName {
+			zoneID = z.ID
+			break
+		}
+	}
+
+	// cache misses as well, so that every lookup hits the API only once
+	c.zoneNames[zoneName] = zoneID
+	return zoneID, nil
+}
+
+// zoneByNameOrID returns the ID of a zone given either by its name or its ID
+func (c *Cloudflare) zoneByNameOrID(zone string) (string, error) {
+	c.zonesLock.Lock()
+	defer c.zonesLock.Unlock()
+
+	zoneID, err := c.zoneIDByName(zone)
+	if err != nil {
+		return "", err
+	}
+
+	// no zone goes by that name, so it has to be an ID
+	if len(zoneID) == 0 {
+		return zone, nil
+	}
+	return zoneID, nil
+}
+
+// Verify checks that the configured API token is active and allowed to edit
+// DNS records in every zone of the configured hosts, and in every zone the
+// external IP is followed throughout. Global API keys are not restricted and
+// always pass.
+func (c *Cloudflare) Verify() error {
+	if len(c.cf.APIToken) == 0 {
+		return nil
+	}
+
+	logger.Debug("[CLOUDFLARE] Verifying API token...")
+	res, err := c.cf.Raw("GET", "/user/tokens/verify", nil)
+	if err != nil {
+		err = fmt.Errorf("failed to verify API token: %s", err.Error())
+		logger.Error(err.Error())
+		return err
+	}
+
+	var token struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	err = json.Unmarshal(res, &token)
 	if err != nil {
 		logger.Error(err.Error())
+		return err
+	}
+
+	if token.Status != "active" {
+		err = fmt.Errorf("API token is not active: [%s]", token.Status)
+		logger.Error(err.Error())
+		return err
+	}
+
+	zoneIDs := make([]string, 0)
+	for _, name := range c.hostnames {
+		zoneID, err := c.zoneFor(name)
+		if err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+		zoneIDs = append(zoneIDs, zoneID)
+	}
+	for _, zone := range c.followZones {
+		zoneID, err := c.zoneByNameOrID(zone)
+		if err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+		zoneIDs = append(zoneIDs, zoneID)
+	}
+
+	verified := make(map[string]bool)
+	for _, zoneID := range zoneIDs {
+		if verified[zoneID] {
+			continue
+		}
+
+		zone, err := c.cf.ZoneDetails(zoneID)
+		if err != nil {
+			err = fmt.Errorf("failed to fetch zone [%s]: %s", zoneID, err.Error())
+			logger.Error(err.Error())
+			return err
+		}
+
+		missing := missingPermissions(zone.Permissions)
+		if len(missing) > 0 {
+			err = fmt.Errorf("API token is missing permissions on zone [%s]: %s", zone.Name, strings.Join(missing, ", "))
+			logger.Error(err.Error())
+			return err
+		}
+
+		logger.Debug("[CLOUDFLARE] API token [%s] verified for zone [%s].", token.ID, zone.Name)
+		verified[zoneID] = true
+	}
+
+	return nil
+}
+
+func missingPermissions(granted []string) []string {
+	grantedMap := make(map[string]bool)
+	for _, p := range granted {
+		grantedMap[p] = true
+	}
+
+	missing := make([]string, 0)
+	for _, p := range requiredPermissions {
+		if !grantedMap[p] {
+			missing = append(missing, p)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
+
+// dnsRecord is a DNS record, including the attributes cf.DNSRecord does not carry
+type dnsRecord struct {
+	cf.DNSRecord
+	Comment string `json:"comment,omitempty"`
+}
+
+func (r *dnsRecord) toRecord() provider.Record {
+	return provider.Record{
+		ID:      r.ID,
+		Type:    r.Type,
+		Name:    r.Name,
+		Content: r.Content,
+		TTL:     r.TTL,
+		Proxied: r.Proxied,
+		Comment: r.Comment,
+	}
+}
+
+// recordParams holds the attributes sent when creating or updating a record.
+// Attributes left empty are omitted, so that updates preserve existing values.
+type recordParams struct {
+	Type    string  `json:"type,omitempty"`
+	Name    string  `json:"name,omitempty"`
+	Content string  `json:"content,omitempty"`
+	Proxied *bool   `json:"proxied,omitempty"`
+	TTL     int     `json:"ttl,omitempty"`
+	Comment *string `json:"comment,omitempty"`
+}
+
+// recordsPerPage is the page size used when listing records
+const recordsPerPage = 100
+
+func newRecordParams(h host.Host, recordType string, content string) recordParams {
+	rr := recordParams{
+		Type:    recordType,
+		Name:    h.Name,
+		Content: content,
+		Proxied: h.Proxied,
+		TTL:     h.TTL,
+	}
+	if len(h.Comment) > 0 {
+		comment := h.Comment
+		rr.Comment = &comment
+	}
+	return rr
+}
+
+func (c *Cloudflare) listRecords(zoneID string, query url.Values) ([]provider.Record, error) {
+	records := make([]provider.Record, 0)
+	query.Set("per_page", strconv.Itoa(recordsPerPage))
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		res, err := c.cf.Raw("GET", "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var pageRecords []dnsRecord
+		err = json.Unmarshal(res, &pageRecords)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range pageRecords {
+			records = append(records, r.toRecord())
+		}
+		if len(pageRecords) < recordsPerPage {
+			return records, nil
+		}
+	}
+}
+
+// Name returns the name of the provider
+func (c *Cloudflare) Name() string {
+	return "cloudflare"
+}
+
+// Fetch fetches the records of the given type for a host
+func (c *Cloudflare) Fetch(h host.Host, recordType string) (result []provider.Record, err error) {
+	logger.Debug("[CLOUDFLARE] Fetching %s record for host [%v]", recordType, h.Name)
+	zoneID, err := c.zoneFor(h.Name)
+	if err != nil {
 		return
 	}
 
-	result = make(map[string]cf.DNSRecord)
-	for _, r := range records {
+	query := url.Values{}
+	query.Set("name", h.Name)
+	query.Set("type", recordType)
+	result, err = c.listRecords(zoneID, query)
+	if err != nil {
+		logger.Debug(err.Error())
+		return
+	}
+
+	for _, r := range result {
 		logger.Debug("[CLOUDFLARE] IP Address for hostname [%s] is [%s]", r.Name, r.Content)
-		result[r.Name] = r
 	}
 
 	return
 }
 
-// CreateA creates an A-record
-func (c *Cloudflare) CreateA(name string, ip net.IP) (result cf.DNSRecord, err error) {
-	logger.Debug("[CLOUDFLARE] Creating A record for host [%v]", name)
-	rr := cf.DNSRecord{
-		Type:    "A",
-		Name:    name,
-		Content: ip.String(),
+// Search finds the records of the given type and content anywhere in a zone,
+// given either by its name or its ID
+func (c *Cloudflare) Search(zone string, recordType string, content string) (result []provider.Record, err error) {
+	logger.Debug("[CLOUDFLARE] Searching zone [%s] for %s records with content [%s]", zone, recordType, content)
+	zoneID, err := c.zoneByNameOrID(zone)
+	if err != nil {
+		logger.Debug(err.Error())
+		return
 	}
 
-	cfResponse, err := c.cf.CreateDNSRecord(c.zoneID, rr)
+	query := url.Values{}
+	query.Set("type", recordType)
+	query.Set("content", content)
+	result, err = c.listRecords(zoneID, query)
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Debug(err.Error())
+	}
+	return
+}
+
+// FetchA fetches the A-records of a host
+func (c *Cloudflare) FetchA(h host.Host) (result []provider.Record, err error) {
+	return c.Fetch(h, "A")
+}
+
+// FetchAAAA fetches the AAAA-records of a host
+func (c *Cloudflare) FetchAAAA(h host.Host) (result []provider.Record, err error) {
+	return c.Fetch(h, "AAAA")
+}
+
+// Create creates a record of the given type, with the attributes configured for the host
+func (c *Cloudflare) Create(h host.Host, recordType string, content string) (result provider.Record, err error) {
+	logger.Debug("[CLOUDFLARE] Creating %s record for host [%v]", recordType, h.Name)
+	zoneID, err := c.zoneFor(h.Name)
+	if err != nil {
+		return
+	}
+
+	res, err := c.cf.Raw("POST", "/zones/"+zoneID+"/dns_records", newRecordParams(h, recordType, content))
+	if err != nil {
+		logger.Debug(err.Error())
 		return result, err
 	}
 
-	result = cfResponse.Result
+	var rec dnsRecord
+	err = json.Unmarshal(res, &rec)
+	if err != nil {
+		logger.Debug(err.Error())
+		return result, err
+	}
+
+	return rec.toRecord(), nil
+}
+
+// CreateA creates an A-record
+func (c *Cloudflare) CreateA(h host.Host, ip net.IP) (result provider.Record, err error) {
+	return c.Create(h, "A", ip.String())
+}
+
+// CreateAAAA creates an AAAA-record
+func (c *Cloudflare) CreateAAAA(h host.Host, ip net.IP) (result provider.Record, err error) {
+	return c.Create(h, "AAAA", ip.String())
+}
+
+// Update updates the content of a record. Only the content and the attributes
+// configured for the host are sent, everything else is preserved.
+func (c *Cloudflare) Update(rec provider.Record, h host.Host, content string) (err error) {
+	logger.Debug("[CLOUDFLARE] Updating %s record for host [%v]", rec.Type, h.Name)
+	zoneID, err := c.zoneFor(h.Name)
+	if err != nil {
+		return
+	}
+
+	_, err = c.cf.Raw("PATCH", "/zones/"+zoneID+"/dns_records/"+rec.ID, newRecordParams(h, rec.Type, content))
+	if err != nil {
+		logger.Debug(err.Error())
+	}
 	return
 }
 
 // UpdateA updates an A-record
-func (c *Cloudflare) UpdateA(recordID string, name string, ip net.IP) (err error) {
-	logger.Debug("[CLOUDFLARE] Updating A record for host [%v]", name)
-	rr := cf.DNSRecord{
-		Type:    "A",
-		Name:    name,
-		Content: ip.String(),
+func (c *Cloudflare) UpdateA(rec provider.Record, h host.Host, ip net.IP) (err error) {
+	return c.Update(rec, h, ip.String())
+}
+
+// UpdateAAAA updates an AAAA-record
+func (c *Cloudflare) UpdateAAAA(rec provider.Record, h host.Host, ip net.IP) (err error) {
+	return c.Update(rec, h, ip.String())
+}
+
+// Delete deletes a record
+func (c *Cloudflare) Delete(rec provider.Record) (err error) {
+	logger.Debug("[CLOUDFLARE] Deleting %s record [%s] for host [%v]", rec.Type, rec.ID, rec.Name)
+	zoneID, err := c.zoneFor(rec.Name)
+	if err != nil {
+		return
 	}
 
-	return c.cf.UpdateDNSRecord(c.zoneID, recordID, rr)
+	_, err = c.cf.Raw("DELETE", "/zones/"+zoneID+"/dns_records/"+rec.ID, nil)
+	if err != nil {
+		logger.Debug(err.Error())
+	}
+	return
 }
@@ -1 +1,718 @@
 package cloudflare
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/kerti/cloudflare-ddns/config"
+	"github.com/kerti/cloudflare-ddns/host"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/provider"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+var (
+	initloglevel uint8 = uint8(0)
+
+	retryTestCases = []struct {
+		name       string
+		create     bool
+		statuses   []int
+		retryAfter string
+		retried    uint64
+		abandoned  uint64
+		errIsNil   bool
+	}{
+		{
+			name:     "success",
+			statuses: []int{200},
+			errIsNil: true,
+		},
+		{
+			name:     "serverErrorThenSuccess",
+			statuses: []int{503, 502, 200},
+			retried:  2,
+			errIsNil: true,
+		},
+		{
+			name:       "rateLimitedThenSuccess",
+			statuses:   []int{429, 200},
+			retryAfter: "0",
+			retried:    1,
+			errIsNil:   true,
+		},
+		{
+			name:      "retriesExhausted",
+			statuses:  []int{500, 500, 500},
+			retried:   2,
+			abandoned: 1,
+			errIsNil:  false,
+		},
+		{
+			name:       "retryAfterBeyondMaxDelay",
+			statuses:   []int{429},
+			retryAfter: "60",
+			abandoned:  1,
+			errIsNil:   false,
+		},
+		{
+			name:     "clientErrorNotRetried",
+			statuses: []int{400},
+			errIsNil: false,
+		},
+		{
+			name:     "createNotReplayedAfterServerError",
+			create:   true,
+			statuses: []int{502},
+			errIsNil: false,
+		},
+		{
+			name:       "createRateLimitedThenSuccess",
+			create:     true,
+			statuses:   []int{429, 200},
+			retryAfter: "0",
+			retried:    1,
+			errIsNil:   true,
+		},
+	}
+
+	checkConfigTestCases = []struct {
+		name      string
+		email     string
+		apiKey    string
+		apiToken  string
+		zoneID    string
+		listID    string
+		accountID string
+		errIsNil  bool
+	}{
+		{
+			name:     "globalKey",
+			email:    "user@example.com",
+			apiKey:   "key",
+			zoneID:   "zone",
+			errIsNil: true,
+		},
+		{
+			name:     "apiToken",
+			apiToken: "token",
+			zoneID:   "zone",
+			errIsNil: true,
+		},
+		{
+			name:     "keyWithoutEmail",
+			apiKey:   "key",
+			zoneID:   "zone",
+			errIsNil: false,
+		},
+		{
+			name:     "noCredentials",
+			zoneID:   "zone",
+			errIsNil: false,
+		},
+		{
+			name:     "noZone",
+			apiToken: "token",
+			errIsNil: true,
+		},
+		{
+			name:      "ipList",
+			apiToken:  "token",
+			listID:    "list",
+			accountID: "acct",
+			errIsNil:  true,
+		},
+		{
+			name:     "ipListWithoutAccount",
+			apiToken: "token",
+			listID:   "list",
+			errIsNil: false,
+		},
+	}
+
+	verifyTestCases = []struct {
+		name        string
+		tokenStatus string
+		permissions string
+		errIsNil    bool
+		errMsg      string
+	}{
+		{
+			name:        "activeWithPermissions",
+			tokenStatus: "active",
+			permissions: `["#dns_records:read", "#dns_records:edit", "#zone:read"]`,
+			errIsNil:    true,
+		},
+		{
+			name:        "disabledToken",
+			tokenStatus: "disabled",
+			permissions: `["#dns_records:read", "#dns_records:edit"]`,
+			errIsNil:    false,
+			errMsg:      "API token is not active: [disabled]",
+		},
+		{
+			name:        "readOnlyToken",
+			tokenStatus: "active",
+			permissions: `["#dns_records:read", "#zone:read"]`,
+			errIsNil:    false,
+			errMsg:      "API token is missing permissions on zone [example.com]: #dns_records:edit",
+		},
+		{
+			name:        "noPermissions",
+			tokenStatus: "active",
+			permissions: `[]`,
+			errIsNil:    false,
+			errMsg:      "API token is missing permissions on zone [example.com]: #dns_records:edit, #dns_records:read",
+		},
+	}
+
+	zoneForTestCases = []struct {
+		name        string
+		host        string
+		defaultZone string
+		result      string
+		errIsNil    bool
+		errMsg      string
+	}{
+		{
+			name:     "override",
+			host:     "override.example.com",
+			result:   "override-zone",
+			errIsNil: true,
+		},
+		{
+			name:     "apex",
+			host:     "example.com",
+			result:   "example-com",
+			errIsNil: true,
+		},
+		{
+			name:     "subdomain",
+			host:     "home.example.com",
+			result:   "example-com",
+			errIsNil: true,
+		},
+		{
+			name:     "longestSuffix",
+			host:     "vpn.sub.example.com",
+			result:   "sub-example-com",
+			errIsNil: true,
+		},
+		{
+			name:     "otherZone",
+			host:     "vpn.example.net",
+			result:   "example-net",
+			errIsNil: true,
+		},
+		{
+			name:        "defaultZone",
+			host:        "home.example.org",
+			defaultZone: "default-zone",
+			result:      "default-zone",
+			errIsNil:    true,
+		},
+		{
+			name:     "unknownZone",
+			host:     "home.example.org",
+			errIsNil: false,
+			errMsg:   "no zone found for host [home.example.org]",
+		},
+	}
+
+	proxied = true
+
+	recordParamsTestCases = []struct {
+		name   string
+		host   host.Host
+		method string
+		body   string
+	}{
+		{
+			name:   "createPlain",
+			host:   host.Host{Name: "home.example.com"},
+			method: "POST",
+			body:   `{"type":"A","name":"home.example.com","content":"1.2.3.4"}`,
+		},
+		{
+			name:   "createConfigured",
+			host:   host.Host{Name: "home.example.com", Proxied: &proxied, TTL: 120, Comment: "managed"},
+			method: "POST",
+			body:   `{"type":"A","name":"home.example.com","content":"1.2.3.4","proxied":true,"ttl":120,"comment":"managed"}`,
+		},
+		{
+			name:   "updatePlain",
+			host:   host.Host{Name: "home.example.com"},
+			method: "PATCH",
+			body:   `{"type":"A","name":"home.example.com","content":"1.2.3.4"}`,
+		},
+		{
+			name:   "updateConfigured",
+			host:   host.Host{Name: "home.example.com", Proxied: &proxied, TTL: 120, Comment: "managed"},
+			method: "PATCH",
+			body:   `{"type":"A","name":"home.example.com","content":"1.2.3.4","proxied":true,"ttl":120,"comment":"managed"}`,
+		},
+	}
+
+	testZones = map[string]string{
+		"example.com":     "example-com",
+		"sub.example.com": "sub-example-com",
+		"example.net":     "example-net",
+	}
+)
+
+// newTestCloudflare returns a client pointing at a fake Cloudflare API
+func newTestCloudflare(t *testing.T, handler http.Handler, hosts ...host.Host) (*Cloudflare, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	transport := newTestTransport()
+	api, err := newAPI("", "", "token", transport)
+	assert.Nil(t, err)
+	api.BaseURL = server.URL
+	c := &Cloudflare{
+		cf:        api,
+		transport: transport,
+		hostnames: make([]string, 0),
+		zones:     make(map[string]string),
+		zoneNames: make(map[string]string),
+	}
+	for _, h := range hosts {
+		c.hostnames = append(c.hostnames, h.Name)
+		if len(h.ZoneID) > 0 {
+			c.zones[h.Name] = h.ZoneID
+		}
+	}
+	return c, server
+}
+
+// newTestTransport returns a retry transport without noticeable delays
+func newTestTransport() *retryTransport {
+	return &retryTransport{
+		next:       http.DefaultTransport,
+		limiter:    rate.NewLimiter(rate.Inf, 1),
+		maxRetries: 2,
+		minDelay:   time.Millisecond,
+		maxDelay:   50 * time.Millisecond,
+		timeout:    time.Second,
+	}
+}
+
+// fakeIPList serves an IP List, two items per page
+type fakeIPList struct {
+	sync.Mutex
+	kind   string
+	items  []listItem
+	nextID int
+}
+
+func (l *fakeIPList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.Lock()
+	defer l.Unlock()
+
+	switch {
+	case r.URL.Path == "/accounts/acct/rules/lists/list":
+		fmt.Fprintf(w, `{"success": true, "result": {"id": "list", "name": "office", "kind": %q}}`, l.kind)
+	case r.URL.Path == "/accounts/acct/rules/lists/bulk_operations/op":
+		fmt.Fprint(w, `{"success": true, "result": {"id": "op", "status": "completed"}}`)
+	case r.URL.Path == "/accounts/acct/rules/lists/list/items" && r.Method == "GET":
+		items := make([]listItem, 0)
+		for _, item := range l.items {
+			if strings.Contains(item.IP, r.URL.Query().Get("search")) {
+				items = append(items, item)
+			}
+		}
+		start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		end := start + 2
+		after := strconv.Itoa(end)
+		if end >= len(items) {
+			end, after = len(items), ""
+		}
+		page, _ := json.Marshal(items[start:end])
+		fmt.Fprintf(w, `{"success": true, "result": %s, "result_info": {"cursors": {"after": %q}}}`, page, after)
+	case r.URL.Path == "/accounts/acct/rules/lists/list/items" && r.Method == "POST":
+		var added []listItem
+		json.NewDecoder(r.Body).Decode(&added)
+		for _, item := range added {
+			l.nextID++
+			item.ID = "new-" + strconv.Itoa(l.nextID)
+			l.items = append(l.items, item)
+		}
+		fmt.Fprint(w, `{"success": true, "result": {"operation_id": "op"}}`)
+	case r.URL.Path == "/accounts/acct/rules/lists/list/items" && r.Method == "DELETE":
+		var removed struct {
+			Items []listItem `json:"items"`
+		}
+		json.NewDecoder(r.Body).Decode(&removed)
+		items := make([]listItem, 0)
+		for _, item := range l.items {
+			if item.ID != removed.Items[0].ID {
+				items = append(items, item)
+			}
+		}
+		l.items = items
+		fmt.Fprint(w, `{"success": true, "result": {"operation_id": "op"}}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"success": false, "errors": [{"code": 7003, "message": "Could not route"}]}`)
+	}
+}
+
+func (l *fakeIPList) contents() []string {
+	l.Lock()
+	defer l.Unlock()
+
+	result := make([]string, 0)
+	for _, item := range l.items {
+		result = append(result, item.IP+" "+item.Comment)
+	}
+	return result
+}
+
+// handleZones serves the zone listing filtered by name out of testZones
+func handleZones(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	zoneID, ok := testZones[name]
+	if !ok {
+		fmt.Fprint(w, `{"success": true, "result": []}`)
+		return
+	}
+	fmt.Fprintf(w, `{"success": true, "result": [{"id": "%s", "name": "%s"}]}`, zoneID, name)
+}
+
+func TestCloudflare(t *testing.T) {
+
+	logger.InitLogger(&initloglevel)
+	configFile := "../config.yaml"
+	config.Load(&configFile)
+
+	t.Run("CheckConfig", func(t *testing.T) {
+		for _, tc := range checkConfigTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				viper.Set("cloudflare.email", tc.email)
+				viper.Set("cloudflare.apiKey", tc.apiKey)
+				viper.Set("cloudflare.apiToken", tc.apiToken)
+				viper.Set("cloudflare.zoneID", tc.zoneID)
+				viper.Set("cloudflare.ipList.listID", tc.listID)
+				viper.Set("cloudflare.ipList.accountID", tc.accountID)
+				err := CheckConfig()
+				assert.Equal(t, tc.errIsNil, err == nil)
+			})
+		}
+	})
+
+	t.Run("caBundle", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		defer server.Close()
+
+		base, err := newBaseTransport("")
+		assert.Nil(t, err)
+		assert.Equal(t, http.DefaultTransport, base)
+
+		_, err = (&http.Client{Transport: base}).Get(server.URL)
+		assert.NotNil(t, err)
+
+		bundle := filepath.Join(t.TempDir(), "proxy-ca.pem")
+		err = ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+		assert.Nil(t, err)
+		base, err = newBaseTransport(bundle)
+		assert.Nil(t, err)
+		res, err := (&http.Client{Transport: base}).Get(server.URL)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+
+		err = ioutil.WriteFile(bundle, []byte("not a certificate"), 0600)
+		assert.Nil(t, err)
+		_, err = newBaseTransport(bundle)
+		assert.NotNil(t, err)
+		assert.Equal(t, "cannot load the Cloudflare CA bundle: no certificates found in CA bundle ["+bundle+"]", err.Error())
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		for _, tc := range verifyTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				mux := http.NewServeMux()
+				mux.HandleFunc("/user/tokens/verify", func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+					fmt.Fprintf(w, `{"success": true, "result": {"id": "abc", "status": "%s"}}`, tc.tokenStatus)
+				})
+				mux.HandleFunc("/zones", handleZones)
+				mux.HandleFunc("/zones/example-com", func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"success": true, "result": {"id": "example-com", "name": "example.com", "permissions": %s}}`, tc.permissions)
+				})
+
+				c, server := newTestCloudflare(t, mux, host.Host{Name: "home.example.com"}, host.Host{Name: "www.example.com"})
+				defer server.Close()
+
+				err := c.Verify()
+				if tc.errIsNil {
+					assert.Nil(t, err)
+				} else {
+					assert.NotNil(t, err)
+					assert.Equal(t, tc.errMsg, err.Error())
+				}
+			})
+		}
+	})
+
+	t.Run("VerifyFollowZones", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/user/tokens/verify", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"success": true, "result": {"id": "abc", "status": "active"}}`)
+		})
+		mux.HandleFunc("/zones", handleZones)
+		mux.HandleFunc("/zones/example-com", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"success": true, "result": {"id": "example-com", "name": "example.com", "permissions": ["#dns_records:read", "#dns_records:edit"]}}`)
+		})
+		mux.HandleFunc("/zones/example-net", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"success": true, "result": {"id": "example-net", "name": "example.net", "permissions": ["#dns_records:read"]}}`)
+		})
+
+		c, server := newTestCloudflare(t, mux, host.Host{Name: "home.example.com"})
+		defer server.Close()
+		c.followZones = []string{"example.net"}
+
+		err := c.Verify()
+		assert.NotNil(t, err)
+		assert.Equal(t, "API token is missing permissions on zone [example.net]: #dns_records:edit", err.Error())
+	})
+
+	t.Run("VerifyGlobalKey", func(t *testing.T) {
+		api, err := cf.New("key", "user@example.com")
+		assert.Nil(t, err)
+		c := Cloudflare{cf: api, zoneID: "zone"}
+		assert.Nil(t, c.Verify())
+	})
+
+	t.Run("zoneFor", func(t *testing.T) {
+		for _, tc := range zoneForTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				mux := http.NewServeMux()
+				mux.HandleFunc("/zones", handleZones)
+
+				c, server := newTestCloudflare(t, mux, host.Host{Name: "override.example.com", ZoneID: "override-zone"})
+				defer server.Close()
+				c.zoneID = tc.defaultZone
+
+				res, err := c.zoneFor(tc.host)
+				if tc.errIsNil {
+					assert.Nil(t, err)
+					assert.Equal(t, tc.result, res)
+					assert.Equal(t, tc.result, c.zones[tc.host])
+				} else {
+					assert.NotNil(t, err)
+					assert.Equal(t, tc.errMsg, err.Error())
+				}
+			})
+		}
+	})
+	t.Run("Fetch", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/zones", handleZones)
+		mux.HandleFunc("/zones/example-com/dns_records", func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "home.example.com", r.URL.Query().Get("name"))
+			assert.Equal(t, "A", r.URL.Query().Get("type"))
+			fmt.Fprint(w, `{"success": true, "result": [{"id": "rec", "type": "A", "name": "home.example.com", "content": "1.2.3.4", "proxied": true, "ttl": 1, "comment": "managed"}]}`)
+		})
+
+		c, server := newTestCloudflare(t, mux)
+		defer server.Close()
+
+		res, err := c.FetchA(host.Host{Name: "home.example.com"})
+		assert.Nil(t, err)
+		assert.Len(t, res, 1)
+		rec := res[0]
+		assert.Equal(t, "rec", rec.ID)
+		assert.Equal(t, "1.2.3.4", rec.Content)
+		assert.True(t, rec.Proxied)
+		assert.Equal(t, 1, rec.TTL)
+		assert.Equal(t, "managed", rec.Comment)
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/zones", handleZones)
+		mux.HandleFunc("/zones/example-com/dns_records", func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "", r.URL.Query().Get("name"))
+			assert.Equal(t, "A", r.URL.Query().Get("type"))
+			assert.Equal(t, "1.2.3.4", r.URL.Query().Get("content"))
+			fmt.Fprint(w, `{"success": true, "result": [{"id": "rec", "type": "A", "name": "www.example.com", "content": "1.2.3.4"}]}`)
+		})
+
+		c, server := newTestCloudflare(t, mux)
+		defer server.Close()
+
+		// zones can be given by name as well as by ID
+		for _, zone := range []string{"example.com", "example-com"} {
+			res, err := c.Search(zone, "A", "1.2.3.4")
+			assert.Nil(t, err)
+			assert.Len(t, res, 1)
+			assert.Equal(t, "www.example.com", res[0].Name)
+		}
+	})
+
+	t.Run("recordParams", func(t *testing.T) {
+		for _, tc := range recordParamsTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				mux := http.NewServeMux()
+				mux.HandleFunc("/zones", handleZones)
+				handler := func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, tc.method, r.Method)
+					body, _ := ioutil.ReadAll(r.Body)
+					assert.JSONEq(t, tc.body, string(body))
+					var rec map[string]interface{}
+					json.Unmarshal(body, &rec)
+					rec["id"] = "rec"
+					res, _ := json.Marshal(map[string]interface{}{"success": true, "result": rec})
+					w.Write(res)
+				}
+				mux.HandleFunc("/zones/example-com/dns_records", handler)
+				mux.HandleFunc("/zones/example-com/dns_records/rec", handler)
+
+				c, server := newTestCloudflare(t, mux)
+				defer server.Close()
+
+				var err error
+				if tc.method == "POST" {
+					var rec provider.Record
+					rec, err = c.CreateA(tc.host, net.ParseIP("1.2.3.4"))
+					assert.Equal(t, "rec", rec.ID)
+					assert.Equal(t, tc.host.Comment, rec.Comment)
+				} else {
+					err = c.UpdateA(provider.Record{ID: "rec", Type: "A"}, tc.host, net.ParseIP("1.2.3.4"))
+				}
+				assert.Nil(t, err)
+			})
+		}
+	})
+	t.Run("Delete", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/zones", handleZones)
+		mux.HandleFunc("/zones/example-com/dns_records/rec", func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "DELETE", r.Method)
+			fmt.Fprint(w, `{"success": true, "result": {"id": "rec"}}`)
+		})
+
+		c, server := newTestCloudflare(t, mux)
+		defer server.Close()
+
+		err := c.Delete(provider.Record{ID: "rec", Type: "A", Name: "home.example.com"})
+		assert.Nil(t, err)
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		for _, tc := range retryTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				calls := 0
+				mux := http.NewServeMux()
+				mux.HandleFunc("/zones", handleZones)
+				handle := func(w http.ResponseWriter, r *http.Request) {
+					body, _ := ioutil.ReadAll(r.Body)
+					assert.Contains(t, string(body), `"content":"1.2.3.4"`)
+
+					status := tc.statuses[calls]
+					calls++
+					if len(tc.retryAfter) > 0 {
+						w.Header().Set("Retry-After", tc.retryAfter)
+					}
+					w.WriteHeader(status)
+					if status == http.StatusOK {
+						fmt.Fprint(w, `{"success": true, "result": {"id": "rec"}}`)
+					} else {
+						fmt.Fprint(w, `{"success": false, "errors": [{"code": 1000, "message": "failed"}]}`)
+					}
+				}
+				mux.HandleFunc("/zones/example-com/dns_records", handle)
+				mux.HandleFunc("/zones/example-com/dns_records/rec", handle)
+
+				c, server := newTestCloudflare(t, mux)
+				defer server.Close()
+
+				h := host.Host{Name: "home.example.com"}
+				var err error
+				if tc.create {
+					_, err = c.CreateA(h, net.ParseIP("1.2.3.4"))
+				} else {
+					err = c.UpdateA(provider.Record{ID: "rec", Type: "A", Name: h.Name}, h, net.ParseIP("1.2.3.4"))
+				}
+				assert.Equal(t, tc.errIsNil, err == nil)
+				assert.Equal(t, len(tc.statuses), calls)
+				assert.Equal(t, provider.Stats{Retried: tc.retried, Abandoned: tc.abandoned}, c.Stats())
+			})
+		}
+
+		t.Run("createRetriedWhenRefused", func(t *testing.T) {
+			server := httptest.NewServer(http.NotFoundHandler())
+			server.Close()
+
+			transport := newTestTransport()
+			req, err := http.NewRequest("POST", server.URL+"/zones/example-com/dns_records", strings.NewReader(`{}`))
+			assert.Nil(t, err)
+			_, err = transport.RoundTrip(req)
+			assert.NotNil(t, err)
+			assert.Equal(t, provider.Stats{Retried: 2, Abandoned: 1}, transport.Stats())
+		})
+	})
+
+	t.Run("IPList", func(t *testing.T) {
+		fake := &fakeIPList{
+			kind: "ip",
+			items: []listItem{
+				{ID: "a", IP: "1.1.1.1", Comment: "cloudflare-ddns"},
+				{ID: "b", IP: "2.2.2.2", Comment: "someone else"},
+				{ID: "c", IP: "10.0.0.0/8", Comment: "cloudflare-ddns"},
+				{ID: "d", IP: "2001:db8::1", Comment: "cloudflare-ddns"},
+				{ID: "e", IP: "5.6.7.8", Comment: "cloudflare-ddns"},
+			},
+		}
+		c, server := newTestCloudflare(t, fake)
+		defer server.Close()
+
+		l := c.IPList("acct", "list")
+		l.pollInterval = time.Millisecond
+		assert.Nil(t, l.Verify())
+
+		h := host.Host{Name: "ip-list/list", Provider: host.ProviderCloudflareIPList, Comment: "cloudflare-ddns"}
+		records, err := l.Fetch(h, host.RecordTypeA)
+		assert.Nil(t, err)
+		assert.Equal(t, []provider.Record{
+			{ID: "a", Type: "A", Name: h.Name, Content: "1.1.1.1", Comment: "cloudflare-ddns"},
+			{ID: "e", Type: "A", Name: h.Name, Content: "5.6.7.8", Comment: "cloudflare-ddns"},
+		}, records)
+
+		rec, err := l.Create(h, host.RecordTypeA, "9.9.9.9")
+		assert.Nil(t, err)
+		assert.Equal(t, provider.Record{ID: "new-1", Type: "A", Name: h.Name, Content: "9.9.9.9", Comment: "cloudflare-ddns"}, rec)
+
+		err = l.Delete(records[0])
+		assert.Nil(t, err)
+		assert.Equal(t, []string{
+			"2.2.2.2 someone else",
+			"10.0.0.0/8 cloudflare-ddns",
+			"2001:db8::1 cloudflare-ddns",
+			"5.6.7.8 cloudflare-ddns",
+			"9.9.9.9 cloudflare-ddns",
+		}, fake.contents())
+
+		fake.kind = "hostname"
+		err = l.Verify()
+		assert.NotNil(t, err)
+		assert.Equal(t, "list [office] is not an IP List: [hostname]", err.Error())
+
+		err = c.IPList("acct", "missing").Verify()
+		assert.NotNil(t, err)
+		assert.Equal(t, "failed to fetch IP List [missing]: API responded with HTTP/404: Could not route (7003)", err.Error())
+	})
+}
@@ -0,0 +1,298 @@
+package cloudflare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/kerti/cloudflare-ddns/host"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/provider"
+)
+
+const (
+	// itemsPerPage is the page size used when listing IP List items
+	itemsPerPage = 500
+
+	// operationPolls is how many times a bulk operation is polled for completion
+	operationPolls = 10
+)
+
+// apiResponse is the envelope of an API response, including the result info
+// that cf.API.Raw does not expose
+type apiResponse struct {
+	cf.Response
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Cursors struct {
+			After string `json:"after"`
+		} `json:"cursors"`
+	} `json:"result_info"`
+}
+
+// request sends a request through the same transport and with the same
+// credentials as the API client
+func (c *Cloudflare) request(method string, endpoint string, data interface{}) (*apiResponse, error) {
+	var body []byte
+	if data != nil {
+		var err error
+		body, err = json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.cf.BaseURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.cf.UserAgent)
+	if len(c.cf.APIToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.cf.APIToken)
+	} else {
+		req.Header.Set("X-Auth-Email", c.cf.APIEmail)
+		req.Header.Set("X-Auth-Key", c.cf.APIKey)
+	}
+
+	client := &http.Client{Transport: c.transport}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var r apiResponse
+	err = json.Unmarshal(resBody, &r)
+	if err != nil {
+		return nil, fmt.Errorf("API responded with HTTP/%d", res.StatusCode)
+	}
+
+	if !r.Success {
+		messages := make([]string, 0)
+		for _, e := range r.Errors {
+			messages = append(messages, fmt.Sprintf("%s (%d)", e.Message, e.Code))
+		}
+		return nil, fmt.Errorf("API responded with HTTP/%d: %s", res.StatusCode, strings.Join(messages, ", "))
+	}
+
+	return &r, nil
+}
+
+// IPList keeps the external IP in an account-level IP List, which WAF rules
+// can refer to. Only the items carrying the configured comment are managed,
+// all other items of the list are left untouched.
+type IPList struct {
+	client       *Cloudflare
+	accountID    string
+	listID       string
+	pollInterval time.Duration
+}
+
+// listItem is an item of an IP List
+type listItem struct {
+	ID      string `json:"id,omitempty"`
+	IP      string `json:"ip"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// IPList returns a client for an IP List of the account, sharing the API client
+func (c *Cloudflare) IPList(accountID string, listID string) *IPList {
+	return &IPList{
+		client:       c,
+		accountID:    accountID,
+		listID:       listID,
+		pollInterval: time.Second,
+	}
+}
+
+func (l *IPList) endpoint() string {
+	return "/accounts/" + l.accountID + "/rules/lists/" + l.listID
+}
+
+// Verify checks that the list exists and holds IP addresses
+func (l *IPList) Verify() error {
+	res, err := l.client.request("GET", l.endpoint(), nil)
+	if err != nil {
+		err = fmt.Errorf("failed to fetch IP List [%s]: %s", l.listID, err.Error())
+		logger.Error(err.Error())
+		return err
+	}
+
+	var list struct {
+		Name string `json:"name"`
+		Kind string `json:"kind"`
+	}
+	err = json.Unmarshal(res.Result, &list)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	if list.Kind != "ip" {
+		err = fmt.Errorf("list [%s] is not an IP List: [%s]", list.Name, list.Kind)
+		logger.Error(err.Error())
+		return err
+	}
+
+	logger.Debug("[CLOUDFLARE] IP List [%s] verified.", list.Name)
+	return nil
+}
+
+// Name returns the name of the provider
+func (l *IPList) Name() string {
+	return host.ProviderCloudflareIPList
+}
+
+func (l *IPList) listItems(search string) ([]listItem, error) {
+	items := make([]listItem, 0)
+	query := url.Values{}
+	query.Set("per_page", strconv.Itoa(itemsPerPage))
+	if len(search) > 0 {
+		query.Set("search", search)
+	}
+
+	for {
+		res, err := l.client.request("GET", l.endpoint()+"/items?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var pageItems []listItem
+		err = json.Unmarshal(res.Result, &pageItems)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, pageItems...)
+		if len(res.ResultInfo.Cursors.After) == 0 {
+			return items, nil
+		}
+		query.Set("cursor", res.ResultInfo.Cursors.After)
+	}
+}
+
+// Fetch fetches the items managed for the host, i.e. those carrying its comment
+func (l *IPList) Fetch(h host.Host, recordType string) ([]provider.Record, error) {
+	logger.Debug("[CLOUDFLARE] Fetching items of IP List [%s]", l.listID)
+	items, err := l.listItems("")
+	if err != nil {
+		logger.Debug(err.Error())
+		return nil, err
+	}
+
+	result := make([]provider.Record, 0)
+	for _, item := range items {
+		ip := net.ParseIP(item.IP)
+		if item.Comment != h.Comment || ip == nil || (ip.To4() != nil) != (recordType == host.RecordTypeA) {
+			continue
+		}
+		result = append(result, provider.Record{ID: item.ID, Type: recordType, Name: h.Name, Content: item.IP, Comment: item.Comment})
+	}
+
+	return result, nil
+}
+
+// Create adds an item to the list
+func (l *IPList) Create(h host.Host, recordType string, content string) (provider.Record, error) {
+	logger.Debug("[CLOUDFLARE] Adding [%s] to IP List [%s]", content, l.listID)
+	res, err := l.client.request("POST", l.endpoint()+"/items", []listItem{{IP: content, Comment: h.Comment}})
+	if err == nil {
+		err = l.wait(res)
+	}
+	if err != nil {
+		logger.Debug(err.Error())
+		return provider.Record{}, err
+	}
+
+	// bulk operations do not return the items, look the new one up
+	items, err := l.listItems(content)
+	if err != nil {
+		logger.Debug(err.Error())
+		return provider.Record{}, err
+	}
+	for _, item := range items {
+		if item.IP == content && item.Comment == h.Comment {
+			return provider.Record{ID: item.ID, Type: recordType, Name: h.Name, Content: item.IP, Comment: item.Comment}, nil
+		}
+	}
+
+	err = fmt.Errorf("item [%s] not found in IP List [%s] after adding it", content, l.listID)
+	logger.Debug(err.Error())
+	return provider.Record{}, err
+}
+
+// Update replaces an item, as items of a list cannot be edited in place
+func (l *IPList) Update(rec provider.Record, h host.Host, content string) error {
+	_, err := l.Create(h, rec.Type, content)
+	if err != nil {
+		return err
+	}
+	return l.Delete(rec)
+}
+
+// Delete removes an item from the list
+func (l *IPList) Delete(rec provider.Record) error {
+	logger.Debug("[CLOUDFLARE] Removing [%s] from IP List [%s]", rec.Content, l.listID)
+	items := map[string][]listItem{"items": {{ID: rec.ID}}}
+	res, err := l.client.request("DELETE", l.endpoint()+"/items", items)
+	if err == nil {
+		err = l.wait(res)
+	}
+	if err != nil {
+		logger.Debug(err.Error())
+	}
+	return err
+}
+
+// wait waits for the bulk operation started by a request to complete
+func (l *IPList) wait(res *apiResponse) error {
+	var op struct {
+		ID string `json:"operation_id"`
+	}
+	err := json.Unmarshal(res.Result, &op)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < operationPolls; i++ {
+		res, err := l.client.request("GET", "/accounts/"+l.accountID+"/rules/lists/bulk_operations/"+op.ID, nil)
+		if err != nil {
+			return err
+		}
+
+		var status struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		err = json.Unmarshal(res.Result, &status)
+		if err != nil {
+			return err
+		}
+
+		switch status.Status {
+		case "completed":
+			return nil
+		case "failed":
+			return fmt.Errorf("IP List operation [%s] failed: %s", op.ID, status.Error)
+		}
+
+		time.Sleep(l.pollInterval)
+	}
+
+	return fmt.Errorf("IP List operation [%s] did not complete in time", op.ID)
+}
@@ -0,0 +1,198 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/provider"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+// retryTransport is an http.RoundTripper that keeps requests under the API rate
+// limit, and retries failed requests with exponential backoff and jitter
+type retryTransport struct {
+	next       http.RoundTripper
+	limiter    *rate.Limiter
+	maxRetries int
+	minDelay   time.Duration
+	maxDelay   time.Duration
+	timeout    time.Duration
+	retried    uint64
+	abandoned  uint64
+}
+
+// newRetryTransport constructs the transport from the config
+func newRetryTransport(next http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		next:       next,
+		limiter:    rate.NewLimiter(rate.Limit(viper.GetFloat64("cloudflare.rateLimit.requestsPerSecond")), viper.GetInt("cloudflare.rateLimit.burst")),
+		maxRetries: viper.GetInt("cloudflare.retry.maxRetries"),
+		minDelay:   viper.GetDuration("cloudflare.retry.minDelay"),
+		maxDelay:   viper.GetDuration("cloudflare.retry.maxDelay"),
+		timeout:    viper.GetDuration("cloudflare.retry.timeout"),
+	}
+}
+
+// RoundTrip performs the request, retrying it as long as the policy allows
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		err := t.limiter.Wait(req.Context())
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := t.try(req)
+		if !retryable(req, res, err) {
+			return res, err
+		}
+
+		delay := t.backoff(attempt, res)
+		reason := describe(res, err)
+		if attempt >= t.maxRetries || delay > t.maxDelay {
+			atomic.AddUint64(&t.abandoned, 1)
+			logger.Debug("[CLOUDFLARE] Request %s %s failed (%s), giving up after %d attempt(s)", req.Method, req.URL.Path, reason, attempt+1)
+			return res, err
+		}
+
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		atomic.AddUint64(&t.retried, 1)
+		logger.Warn("[CLOUDFLARE] Request %s %s failed (%s), retrying in %s", req.Method, req.URL.Path, reason, delay)
+		time.Sleep(delay)
+	}
+}
+
+// try performs a single attempt of the request, bounded by the timeout
+func (t *retryTransport) try(req *http.Request) (*http.Response, error) {
+	attemptReq := req
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		attemptReq = req.WithContext(req.Context())
+		attemptReq.Body = body
+	}
+
+	if t.timeout <= 0 {
+		return t.next.RoundTrip(attemptReq)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	res, err := t.next.RoundTrip(attemptReq.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the timeout must keep covering the body until it has been read
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// backoff returns the delay before the next attempt, honouring Retry-After
+func (t *retryTransport) backoff(attempt int, res *http.Response) time.Duration {
+	delay := time.Duration(float64(t.minDelay) * math.Pow(2, float64(attempt)))
+	if delay > t.maxDelay {
+		delay = t.maxDelay
+	}
+
+	// full jitter on the upper half, so that retries do not line up
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+
+	if retryAfter := parseRetryAfter(res); retryAfter > delay {
+		delay = retryAfter
+	}
+
+	return delay
+}
+
+// Stats returns the number of retried and abandoned calls so far
+func (t *retryTransport) Stats() provider.Stats {
+	return provider.Stats{
+		Retried:   atomic.LoadUint64(&t.retried),
+		Abandoned: atomic.LoadUint64(&t.abandoned),
+	}
+}
+
+// retryable tells whether the attempt can be repeated. A POST creates another
+// record or list item every time it reaches the API, so it is only repeated
+// when it surely did not: when it was rate limited, or no connection could be
+// made. Otherwise the records are fetched again before creating, in the next
+// cycle.
+func retryable(req *http.Request, res *http.Response, err error) bool {
+	if req.Method == http.MethodPost {
+		if err != nil {
+			return notSent(err)
+		}
+		return res.StatusCode == http.StatusTooManyRequests
+	}
+
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+// notSent tells whether the request failed before it was sent, because the
+// connection was refused or could not be made otherwise
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func describe(res *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return res.Status
+}
+
+func parseRetryAfter(res *http.Response) time.Duration {
+	if res == nil {
+		return 0
+	}
+
+	value := res.Header.Get("Retry-After")
+	if len(value) == 0 {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
+
+// cancelBody releases the attempt's context once the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
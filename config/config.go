@@ -21,8 +21,28 @@ func Load(optConfig *string) error {
 
 	/* set default config values */
 	viper.SetDefault("loglevel", 3)
-	viper.SetDefault("resolver.noVerify", true)
+	viper.SetDefault("resolver.quorum.enabled", false)
+	viper.SetDefault("resolver.quorum.size", 3)
+	viper.SetDefault("resolver.quorum.min", 2)
+	viper.SetDefault("resolver.breaker.threshold", 3)
+	viper.SetDefault("resolver.breaker.coolDown", "5m")
+	viper.SetDefault("resolver.breaker.maxCoolDown", "1h")
+	viper.SetDefault("resolver.validation.enabled", true)
+	viper.SetDefault("resolver.prefixLength", 64)
 	viper.SetDefault("worker.checkInterval", "auto")
+	viper.SetDefault("worker.concurrency", 4)
+
+	viper.SetDefault("cloudflare.retry.maxRetries", 3)
+	viper.SetDefault("cloudflare.retry.minDelay", "1s")
+	viper.SetDefault("cloudflare.retry.maxDelay", "30s")
+	viper.SetDefault("cloudflare.retry.timeout", "10s")
+	viper.SetDefault("cloudflare.rateLimit.requestsPerSecond", 4)
+	viper.SetDefault("cloudflare.rateLimit.burst", 1)
+	viper.SetDefault("cloudflare.ipList.comment", "cloudflare-ddns")
+	viper.SetDefault("cloudflare.follow.enabled", false)
+
+	viper.SetDefault("ownership.mode", "off")
+	viper.SetDefault("ownership.instanceID", "cloudflare-ddns")
 
 	viper.SetDefault("notifier.ifttt.webhook.active", false)
 	viper.SetDefault("notifier.ifttt.webhook.eventName", "cf_ddns_update")
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Networks parses a list of networks in CIDR notation. A plain address stands
+// for a network of that address alone.
+func Networks(cidrs []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: [%s]", cidr)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// CertPool reads the PEM encoded CA certificates of a bundle, which are then
+// trusted instead of the system ones
+func CertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle [%s]", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,229 @@
+package host
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kerti/cloudflare-ddns/config"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+const (
+	// FamilyIPv4 publishes the external IPv4 address only
+	FamilyIPv4 = "ipv4"
+	// FamilyIPv6 publishes the external IPv6 address only
+	FamilyIPv6 = "ipv6"
+	// FamilyDual publishes both the external IPv4 and IPv6 addresses
+	FamilyDual = "dual"
+
+	// RecordTypeA is the DNS record type for IPv4 addresses
+	RecordTypeA = "A"
+	// RecordTypeAAAA is the DNS record type for IPv6 addresses
+	RecordTypeAAAA = "AAAA"
+
+	// PolicySingle keeps exactly one record, updating it in place and deleting
+	// any duplicates
+	PolicySingle = "single"
+	// PolicyEnsurePresent adds a record with the external IP when missing,
+	// leaving any other records of the host untouched
+	PolicyEnsurePresent = "ensure-present"
+	// PolicyReplaceAll makes a record with the external IP the only record of
+	// the host, adding it first and deleting all others afterwards
+	PolicyReplaceAll = "replace-all"
+
+	// ProviderCloudflare manages records through the Cloudflare API
+	ProviderCloudflare = "cloudflare"
+	// ProviderRFC2136 manages records through RFC 2136 dynamic updates
+	ProviderRFC2136 = "rfc2136"
+	// ProviderCloudflareIPList manages the items of a Cloudflare account IP List
+	ProviderCloudflareIPList = "cloudflare-ip-list"
+)
+
+// Providers lists the supported DNS providers, each of which has its own list
+// of hostnames in the config, e.g. cloudflare.hostnames
+var Providers = []string{ProviderCloudflare, ProviderRFC2136}
+
+// Host represents a hostname to be kept up to date
+type Host struct {
+	Name     string
+	Provider string
+	Family   string
+	Policy   string
+	ZoneID   string
+	Proxied  *bool
+	TTL      int
+	Comment  string
+	Adopt    bool
+	Uplink   string
+	Allow    []*net.IPNet `mapstructure:"-"`
+	Deny     []*net.IPNet `mapstructure:"-"`
+	Suffix   string
+}
+
+// Get constructs all hosts of all providers from the config
+func Get() ([]Host, error) {
+	result := make([]Host, 0)
+	for _, provider := range Providers {
+		entries, ok := viper.Get(provider + ".hostnames").([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, entry := range entries {
+			h, err := parse(entry)
+			if err != nil {
+				logger.Error(err.Error())
+				return nil, err
+			}
+			h.Provider = provider
+			result = append(result, h)
+		}
+	}
+
+	// the IP List is kept in sync like a host having a single record
+	listID := viper.GetString("cloudflare.ipList.listID")
+	if len(listID) > 0 {
+		result = append(result, Host{
+			Name:     "ip-list/" + listID,
+			Provider: ProviderCloudflareIPList,
+			Family:   FamilyIPv4,
+			Policy:   PolicyReplaceAll,
+			Comment:  viper.GetString("cloudflare.ipList.comment"),
+		})
+	}
+
+	return result, nil
+}
+
+// Filter returns the hosts managed by the given provider
+func Filter(hosts []Host, provider string) []Host {
+	result := make([]Host, 0)
+	for _, h := range hosts {
+		if h.Provider == provider {
+			result = append(result, h)
+		}
+	}
+	return result
+}
+
+func parse(entry interface{}) (Host, error) {
+	h := Host{}
+	var networks struct {
+		Allow []string
+		Deny  []string
+	}
+	switch e := entry.(type) {
+	case string:
+		h.Name = e
+	default:
+		err := mapstructure.Decode(e, &h)
+		if err != nil {
+			return h, err
+		}
+		err = mapstructure.Decode(e, &networks)
+		if err != nil {
+			return h, err
+		}
+	}
+
+	if len(h.Name) == 0 {
+		return h, fmt.Errorf("hostname entry without a name: %v", entry)
+	}
+
+	h.Family = strings.ToLower(h.Family)
+	if len(h.Family) == 0 {
+		h.Family = FamilyIPv4
+	}
+
+	switch h.Family {
+	case FamilyIPv4, FamilyIPv6, FamilyDual:
+	default:
+		return h, fmt.Errorf("unsupported address family for host [%s]: [%s]", h.Name, h.Family)
+	}
+
+	h.Policy = strings.ToLower(h.Policy)
+	if len(h.Policy) == 0 {
+		h.Policy = PolicySingle
+	}
+
+	switch h.Policy {
+	case PolicySingle, PolicyEnsurePresent, PolicyReplaceAll:
+	default:
+		return h, fmt.Errorf("unsupported record policy for host [%s]: [%s]", h.Name, h.Policy)
+	}
+
+	if h.TTL < 0 {
+		return h, fmt.Errorf("invalid TTL for host [%s]: [%d]", h.Name, h.TTL)
+	}
+
+	if len(h.Suffix) > 0 {
+		suffix := net.ParseIP(h.Suffix)
+		if suffix == nil || suffix.To4() != nil {
+			return h, fmt.Errorf("invalid IPv6 suffix for host [%s]: [%s]", h.Name, h.Suffix)
+		}
+		if h.Family == FamilyIPv4 {
+			return h, fmt.Errorf("IPv6 suffix for host [%s] requires the ipv6 or dual family", h.Name)
+		}
+	}
+
+	var err error
+	if len(networks.Allow) > 0 {
+		h.Allow, err = config.Networks(networks.Allow)
+		if err != nil {
+			return h, fmt.Errorf("host [%s]: %s", h.Name, err.Error())
+		}
+	}
+	if len(networks.Deny) > 0 {
+		h.Deny, err = config.Networks(networks.Deny)
+		if err != nil {
+			return h, fmt.Errorf("host [%s]: %s", h.Name, err.Error())
+		}
+	}
+
+	return h, nil
+}
+
+// RecordTypes returns the DNS record types the host should be published as
+func (h *Host) RecordTypes() []string {
+	switch h.Family {
+	case FamilyIPv6:
+		return []string{RecordTypeAAAA}
+	case FamilyDual:
+		return []string{RecordTypeA, RecordTypeAAAA}
+	default:
+		return []string{RecordTypeA}
+	}
+}
+
+// IsProxied returns true if the host is configured to be proxied. When proxied
+// is not configured, the current setting of the record is returned instead.
+func (h *Host) IsProxied(current bool) bool {
+	if h.Proxied == nil {
+		return current
+	}
+	return *h.Proxied
+}
+
+// Permits checks whether the IP may be published for the host. It must not be
+// in any of the denied networks, and must be in one of the allowed networks
+// when there are any.
+func (h *Host) Permits(ip net.IP) bool {
+	for _, network := range h.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(h.Allow) == 0 {
+		return true
+	}
+	for _, network := range h.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package host
+
+import (
+	"net"
+	"testing"
+
+	"github.com/kerti/cloudflare-ddns/config"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	initloglevel uint8 = uint8(0)
+	proxied            = true
+
+	parseTestCases = []struct {
+		name     string
+		entry    interface{}
+		result   Host
+		errIsNil bool
+		errMsg   string
+	}{
+		{
+			name:     "plainString",
+			entry:    "home.example.com",
+			result:   Host{Name: "home.example.com", Family: FamilyIPv4, Policy: PolicySingle},
+			errIsNil: true,
+		},
+		{
+			name:     "mapWithFamily",
+			entry:    map[interface{}]interface{}{"name": "home.example.com", "family": "IPv6"},
+			result:   Host{Name: "home.example.com", Family: FamilyIPv6, Policy: PolicySingle},
+			errIsNil: true,
+		},
+		{
+			name:     "mapWithoutFamily",
+			entry:    map[string]interface{}{"name": "home.example.com"},
+			result:   Host{Name: "home.example.com", Family: FamilyIPv4, Policy: PolicySingle},
+			errIsNil: true,
+		},
+		{
+			name:     "mapWithAttributes",
+			entry:    map[interface{}]interface{}{"name": "home.example.com", "proxied": true, "ttl": 120, "comment": "managed"},
+			result:   Host{Name: "home.example.com", Family: FamilyIPv4, Policy: PolicySingle, Proxied: &proxied, TTL: 120, Comment: "managed"},
+			errIsNil: true,
+		},
+		{
+			name:     "mapWithPolicy",
+			entry:    map[string]interface{}{"name": "home.example.com", "policy": "Replace-All", "adopt": true},
+			result:   Host{Name: "home.example.com", Family: FamilyIPv4, Policy: PolicyReplaceAll, Adopt: true},
+			errIsNil: true,
+		},
+		{
+			name:     "mapWithUplink",
+			entry:    map[string]interface{}{"name": "wan2.site.example.com", "uplink": "wan2"},
+			result:   Host{Name: "wan2.site.example.com", Family: FamilyIPv4, Policy: PolicySingle, Uplink: "wan2"},
+			errIsNil: true,
+		},
+		{
+			name:     "mapWithNetworks",
+			entry:    map[string]interface{}{"name": "home.example.com", "allow": []interface{}{"203.0.113.0/24"}, "deny": []interface{}{"203.0.113.7", "2001:db8::/32"}},
+			result:   Host{Name: "home.example.com", Family: FamilyIPv4, Policy: PolicySingle, Allow: networks("203.0.113.0/24"), Deny: networks("203.0.113.7", "2001:db8::/32")},
+			errIsNil: true,
+		},
+		{
+			name:     "invalidNetwork",
+			entry:    map[string]interface{}{"name": "home.example.com", "deny": []interface{}{"203.0.113.0/33"}},
+			errIsNil: false,
+			errMsg:   "host [home.example.com]: invalid network: [203.0.113.0/33]",
+		},
+		{
+			name:     "mapWithSuffix",
+			entry:    map[string]interface{}{"name": "nas.example.com", "family": "ipv6", "suffix": "::1:10"},
+			result:   Host{Name: "nas.example.com", Family: FamilyIPv6, Policy: PolicySingle, Suffix: "::1:10"},
+			errIsNil: true,
+		},
+		{
+			name:     "invalidSuffix",
+			entry:    map[string]interface{}{"name": "nas.example.com", "family": "ipv6", "suffix": "10.0.0.1"},
+			errIsNil: false,
+			errMsg:   "invalid IPv6 suffix for host [nas.example.com]: [10.0.0.1]",
+		},
+		{
+			name:     "suffixWithoutIPv6",
+			entry:    map[string]interface{}{"name": "nas.example.com", "suffix": "::1:10"},
+			errIsNil: false,
+			errMsg:   "IPv6 suffix for host [nas.example.com] requires the ipv6 or dual family",
+		},
+		{
+			name:     "unsupportedPolicy",
+			entry:    map[string]interface{}{"name": "home.example.com", "policy": "merge"},
+			errIsNil: false,
+			errMsg:   "unsupported record policy for host [home.example.com]: [merge]",
+		},
+		{
+			name:     "negativeTTL",
+			entry:    map[string]interface{}{"name": "home.example.com", "ttl": -1},
+			errIsNil: false,
+			errMsg:   "invalid TTL for host [home.example.com]: [-1]",
+		},
+		{
+			name:     "mapWithoutName",
+			entry:    map[string]interface{}{"family": "dual"},
+			errIsNil: false,
+			errMsg:   "hostname entry without a name: map[family:dual]",
+		},
+		{
+			name:     "unsupportedFamily",
+			entry:    map[string]interface{}{"name": "home.example.com", "family": "ipx"},
+			errIsNil: false,
+			errMsg:   "unsupported address family for host [home.example.com]: [ipx]",
+		},
+	}
+
+	recordTypesTestCases = []struct {
+		name   string
+		family string
+		result []string
+	}{
+		{
+			name:   "ipv4",
+			family: FamilyIPv4,
+			result: []string{RecordTypeA},
+		},
+		{
+			name:   "ipv6",
+			family: FamilyIPv6,
+			result: []string{RecordTypeAAAA},
+		},
+		{
+			name:   "dual",
+			family: FamilyDual,
+			result: []string{RecordTypeA, RecordTypeAAAA},
+		},
+	}
+)
+
+// networks parses networks known to be valid
+func networks(cidrs ...string) []*net.IPNet {
+	result, _ := config.Networks(cidrs)
+	return result
+}
+
+func TestHost(t *testing.T) {
+
+	logger.InitLogger(&initloglevel)
+	configFile := "../config.yaml"
+	config.Load(&configFile)
+
+	t.Run("Get", func(t *testing.T) {
+		viper.Set("cloudflare.hostnames", []interface{}{
+			"a.example.com",
+			map[interface{}]interface{}{"name": "b.example.com", "family": "dual"},
+		})
+		viper.Set("rfc2136.hostnames", []interface{}{
+			"c.example.org",
+		})
+		res, err := Get()
+		assert.Nil(t, err)
+		assert.Equal(t, []Host{
+			{Name: "a.example.com", Provider: ProviderCloudflare, Family: FamilyIPv4, Policy: PolicySingle},
+			{Name: "b.example.com", Provider: ProviderCloudflare, Family: FamilyDual, Policy: PolicySingle},
+			{Name: "c.example.org", Provider: ProviderRFC2136, Family: FamilyIPv4, Policy: PolicySingle},
+		}, res)
+		assert.Equal(t, res[:2], Filter(res, ProviderCloudflare))
+		assert.Equal(t, res[2:], Filter(res, ProviderRFC2136))
+		viper.Set("rfc2136.hostnames", nil)
+
+		viper.Set("cloudflare.ipList.listID", "list")
+		res, err = Get()
+		assert.Nil(t, err)
+		assert.Equal(t, []Host{
+			{Name: "ip-list/list", Provider: ProviderCloudflareIPList, Family: FamilyIPv4, Policy: PolicyReplaceAll, Comment: "cloudflare-ddns"},
+		}, Filter(res, ProviderCloudflareIPList))
+		viper.Set("cloudflare.ipList.listID", "")
+	})
+
+	t.Run("parse", func(t *testing.T) {
+		for _, tc := range parseTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				res, err := parse(tc.entry)
+				if tc.errIsNil {
+					assert.Nil(t, err)
+					assert.Equal(t, tc.result, res)
+				} else {
+					assert.NotNil(t, err)
+					assert.Equal(t, tc.errMsg, err.Error())
+				}
+			})
+		}
+	})
+
+	t.Run("Permits", func(t *testing.T) {
+		h := Host{Name: "example.com"}
+		assert.True(t, h.Permits(net.ParseIP("203.0.113.7")))
+
+		h.Allow = networks("203.0.113.0/24", "2001:db8::/32")
+		h.Deny = networks("203.0.113.7")
+		assert.True(t, h.Permits(net.ParseIP("203.0.113.8")))
+		assert.True(t, h.Permits(net.ParseIP("2001:db8::1")))
+		assert.False(t, h.Permits(net.ParseIP("203.0.113.7")))
+		assert.False(t, h.Permits(net.ParseIP("198.51.100.9")))
+	})
+
+	t.Run("RecordTypes", func(t *testing.T) {
+		for _, tc := range recordTypesTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				h := Host{Name: "example.com", Family: tc.family}
+				assert.Equal(t, tc.result, h.RecordTypes())
+			})
+		}
+	})
+}
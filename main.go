@@ -10,6 +10,7 @@ import (
 	"github.com/kerti/cloudflare-ddns/cloudflare"
 	"github.com/kerti/cloudflare-ddns/config"
 	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/rfc2136"
 	"github.com/kerti/cloudflare-ddns/worker"
 )
 
@@ -18,6 +19,13 @@ import (
 /* command-line arguments */
 var (
 	optConfig = flag.String("config", "./config.yaml", "config file to use")
+	optDryRun = flag.Bool("dry-run", false, "print the changes that would be made without applying them, then exit")
+	optOutput = flag.String("output", worker.PlanFormatText, "format of the printed plan, text or json")
+)
+
+/* subcommands */
+const (
+	cmdPlan = "plan"
 )
 
 var (
@@ -36,7 +44,8 @@ var (
 /**********************************************************************/
 
 func initialize() error {
-	fmt.Printf("[cloudflare-ddns] v%s.%s-%s build %s\n", majVersion, minVersion, verSuffix, buildNum)
+	// keep stdout clean for the plan output
+	fmt.Fprintf(os.Stderr, "[cloudflare-ddns] v%s.%s-%s build %s\n", majVersion, minVersion, verSuffix, buildNum)
 
 	err := logger.InitLogger(&initialLoglevel)
 	if err != nil {
@@ -56,16 +65,58 @@ func initialize() error {
 		return err
 	}
 
+	err = rfc2136.CheckConfig()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
 	return nil
 }
 
+// plan prints the changes the worker would make
+func plan() error {
+	if *optOutput != worker.PlanFormatText && *optOutput != worker.PlanFormatJSON {
+		return fmt.Errorf("unsupported plan format: [%s]", *optOutput)
+	}
+
+	w := new(worker.Worker)
+	changes, err := w.Plan()
+	if err != nil {
+		return err
+	}
+
+	return worker.WritePlan(os.Stdout, changes, *optOutput)
+}
+
 func main() {
+	// the plan subcommand comes before any flags
+	planMode := false
+	if len(os.Args) > 1 && os.Args[1] == cmdPlan {
+		planMode = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	err := initialize()
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
+	if flag.NArg() > 0 {
+		logger.Error("unknown command: [%s]", flag.Arg(0))
+		os.Exit(2)
+	}
+
+	if planMode || *optDryRun {
+		err = plan()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	w := new(worker.Worker)
 	err = w.Run()
 	if err != nil {
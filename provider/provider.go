@@ -0,0 +1,48 @@
+package provider
+
+import (
+	"github.com/kerti/cloudflare-ddns/host"
+)
+
+// Record is a DNS record as managed by a provider
+type Record struct {
+	ID      string
+	Type    string
+	Name    string
+	Content string
+	TTL     int
+	Proxied bool
+	Comment string
+}
+
+// Provider is a DNS service capable of managing address records
+type Provider interface {
+	// Name returns the name of the provider
+	Name() string
+	// Fetch fetches all records of the given type for a host
+	Fetch(h host.Host, recordType string) ([]Record, error)
+	// Create creates a record of the given type for a host
+	Create(h host.Host, recordType string, content string) (Record, error)
+	// Update sets the content of an existing record of a host
+	Update(rec Record, h host.Host, content string) error
+	// Delete deletes an existing record
+	Delete(rec Record) error
+}
+
+// Stats holds the API call statistics of a provider
+type Stats struct {
+	Retried   uint64
+	Abandoned uint64
+}
+
+// StatsReporter is implemented by providers keeping API call statistics
+type StatsReporter interface {
+	// Stats returns the API call statistics so far
+	Stats() Stats
+}
+
+// ZoneSearcher is implemented by providers able to search a whole zone
+type ZoneSearcher interface {
+	// Search finds the records of the given type and content in a zone
+	Search(zone string, recordType string, content string) ([]Record, error)
+}
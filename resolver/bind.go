@@ -0,0 +1,58 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// isBound checks whether the resolver leaves through a given source address
+// or interface instead of the default route
+func (r *Resolver) isBound() bool {
+	return len(r.BindAddress) > 0 || len(r.BindInterface) > 0
+}
+
+// bindDialer binds the connections of the dialer to the configured source
+// address and interface, so that the resolver sees the external IP of the
+// uplink they belong to
+func (r *Resolver) bindDialer(dialer *net.Dialer, network string) error {
+	if len(r.BindAddress) > 0 {
+		ip := net.ParseIP(r.BindAddress)
+		if ip == nil {
+			return fmt.Errorf("invalid bind address for resolver [%s]: [%s]", r.Name, r.BindAddress)
+		}
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+
+	if len(r.BindInterface) > 0 {
+		control, err := bindToDevice(r.BindInterface)
+		if err != nil {
+			return fmt.Errorf("cannot bind resolver [%s] to interface [%s]: %s", r.Name, r.BindInterface, err.Error())
+		}
+		dialer.Control = control
+	}
+
+	return nil
+}
+
+// listenPacket listens for datagrams on a random port, bound like the dialers
+// of the resolver
+func (r *Resolver) listenPacket(network string) (net.PacketConn, error) {
+	dialer := &net.Dialer{}
+	err := r.bindDialer(dialer, network)
+	if err != nil {
+		return nil, err
+	}
+
+	address := ":0"
+	if local, ok := dialer.LocalAddr.(*net.UDPAddr); ok {
+		address = net.JoinHostPort(local.IP.String(), "0")
+	}
+	config := net.ListenConfig{Control: dialer.Control}
+	return config.ListenPacket(context.Background(), network, address)
+}
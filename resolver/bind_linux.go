@@ -0,0 +1,24 @@
+package resolver
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDevice returns a dialer control function binding the socket to the
+// named interface with SO_BINDTODEVICE, which requires CAP_NET_RAW
+func bindToDevice(device string) (func(network string, address string, c syscall.RawConn) error, error) {
+	return func(network string, address string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = syscall.BindToDevice(int(fd), device)
+		})
+		if err != nil {
+			return err
+		}
+		if bindErr != nil {
+			return fmt.Errorf("cannot bind to interface [%s]: %s", device, bindErr.Error())
+		}
+		return nil
+	}, nil
+}
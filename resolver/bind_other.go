@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package resolver
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDevice is not available on this platform, use a bind address instead
+func bindToDevice(device string) (func(network string, address string, c syscall.RawConn) error, error) {
+	return nil, fmt.Errorf("binding to an interface is only supported on Linux")
+}
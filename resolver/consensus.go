@@ -0,0 +1,70 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrNoQuorum is returned when not enough resolvers agree on the external IP
+var ErrNoQuorum = errors.New("no quorum reached on the external IP")
+
+// Vote is the answer of a single resolver in a consensus
+type Vote struct {
+	Resolver string
+	IP       net.IP
+	Err      error
+}
+
+func (v Vote) String() string {
+	if v.Err != nil {
+		return fmt.Sprintf("%s: %s", v.Resolver, v.Err.Error())
+	}
+	return fmt.Sprintf("%s: %v", v.Resolver, v.IP)
+}
+
+// Consensus queries the resolvers in parallel through the query function, and
+// returns the IP at least quorum of them agree on, along with the votes of the
+// ones that dissented. When no IP reaches the quorum, all votes are returned
+// with ErrNoQuorum.
+func Consensus(resolvers []Resolver, quorum int, query func(Resolver) (net.IP, error)) (net.IP, []Vote, error) {
+	votes := make([]Vote, len(resolvers))
+	var wg sync.WaitGroup
+	for i := range resolvers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip, err := query(resolvers[i])
+			votes[i] = Vote{Resolver: resolvers[i].Name, IP: ip, Err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	// ties go to the IP answered first in the order of the resolvers
+	counts := make(map[string]int)
+	winner := ""
+	for _, v := range votes {
+		if v.Err != nil || v.IP == nil {
+			continue
+		}
+		ip := v.IP.String()
+		counts[ip]++
+		if counts[ip] > counts[winner] {
+			winner = ip
+		}
+	}
+
+	if len(winner) == 0 || counts[winner] < quorum {
+		return nil, votes, ErrNoQuorum
+	}
+
+	dissent := make([]Vote, 0)
+	for _, v := range votes {
+		if v.Err != nil || v.IP == nil || v.IP.String() != winner {
+			dissent = append(dissent, v)
+		}
+	}
+
+	return net.ParseIP(winner), dissent, nil
+}
@@ -0,0 +1,122 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/miekg/dns"
+)
+
+// dnsTimeout is the default dial timeout of the DNS client, which a dialer of
+// our own must set again
+const dnsTimeout = 2 * time.Second
+
+// initDNS initializes the DNS client. The timeout of the resolver bounds the
+// whole query, unless left to the defaults of the client.
+func (r *Resolver) initDNS() error {
+	r.DNSClient = &dns.Client{Net: r.udpNetwork(), Timeout: r.Timeout}
+	if !r.isBound() {
+		return nil
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = dnsTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	err := r.bindDialer(dialer, r.DNSClient.Net)
+	if err != nil {
+		return err
+	}
+	r.DNSClient.Dialer = dialer
+	return nil
+}
+
+// queryTypeClass returns the type and class of the query, defaulting to an
+// address query of the forced address family in the IN class
+func (r *Resolver) queryTypeClass() (uint16, uint16, error) {
+	queryType := strings.ToUpper(r.QueryType)
+	if len(queryType) == 0 {
+		queryType = "A"
+		if r.IsIPv6() {
+			queryType = "AAAA"
+		}
+	}
+
+	qtype, ok := dns.StringToType[queryType]
+	if !ok || (qtype != dns.TypeA && qtype != dns.TypeAAAA && qtype != dns.TypeTXT) {
+		return 0, 0, fmt.Errorf("unsupported DNS query type: [%s]", r.QueryType)
+	}
+
+	queryClass := strings.ToUpper(r.QueryClass)
+	if len(queryClass) == 0 {
+		queryClass = "IN"
+	}
+
+	qclass, ok := dns.StringToClass[queryClass]
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported DNS query class: [%s]", r.QueryClass)
+	}
+
+	return qtype, qclass, nil
+}
+
+// getExternalIPDNS queries the DNS server and reads the external IP from the
+// first A, AAAA or TXT record of the answer
+func (r *Resolver) getExternalIPDNS() (net.IP, error) {
+	if len(r.Server) == 0 || len(r.Query) == 0 {
+		err := fmt.Errorf("DNS resolver [%s] requires a server and a query", r.Name)
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	qtype, qclass, err := r.queryTypeClass()
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	server := r.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(r.Query), qtype)
+	m.Question[0].Qclass = qclass
+
+	res, _, err := r.DNSClient.Exchange(m, server)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	if res.Rcode != dns.RcodeSuccess {
+		err = fmt.Errorf("DNS server responded with %s", dns.RcodeToString[res.Rcode])
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	for _, rr := range res.Answer {
+		var ip net.IP
+		switch answer := rr.(type) {
+		case *dns.A:
+			ip = answer.A.To16()
+		case *dns.AAAA:
+			ip = answer.AAAA
+		case *dns.TXT:
+			ip = findIP(strings.Join(answer.Txt, " "))
+		}
+		if ip != nil {
+			logger.Debug("[RESOLVER] [%s] Detected external IP: %v", r.Server, ip)
+			return ip, nil
+		}
+	}
+
+	err = fmt.Errorf("no IP in DNS answer for [%s]", r.Query)
+	logger.Error(err.Error())
+	return nil, err
+}
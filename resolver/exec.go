@@ -0,0 +1,86 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/kerti/cloudflare-ddns/logger"
+)
+
+// execWaitDelay is how long the output of a command that timed out is still
+// waited for, before its pipes are closed
+var execWaitDelay = 100 * time.Millisecond
+
+// getExternalIPExec runs the configured command, and reads the external IP
+// from its standard output
+func (r *Resolver) getExternalIPExec() (net.IP, error) {
+	if len(r.Command) == 0 {
+		err := fmt.Errorf("exec resolver [%s] requires a command", r.Name)
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, r.Command, r.Args...)
+	cmd.Env = append(os.Environ(), r.Env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = execWaitDelay
+	killGroup(cmd)
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("command [%s] timed out after %s", r.Command, timeout)
+		logger.Error(err.Error())
+		return nil, err
+	}
+	if err != nil {
+		if output := strings.TrimSpace(stderr.String()); len(output) > 0 {
+			err = fmt.Errorf("command [%s] failed: %s [%s]", r.Command, err.Error(), output)
+		} else {
+			err = fmt.Errorf("command [%s] failed: %s", r.Command, err.Error())
+		}
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	ip := r.findIPOutput(stdout.String())
+	if ip == nil {
+		err = fmt.Errorf("cannot parse IP: [%v]", strings.TrimSpace(stdout.String()))
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	logger.Debug("[RESOLVER] [%s] Detected external IP: %v", r.Command, ip)
+	return ip, nil
+}
+
+// findIPOutput returns the first IP in the output of the command, skipping
+// those of the other family when the resolver is forced to one
+func (r *Resolver) findIPOutput(output string) net.IP {
+	for _, field := range strings.Fields(output) {
+		ip := findIP(field)
+		if ip == nil {
+			continue
+		}
+		isIPv4 := ip.To4() != nil
+		if (r.Network == "tcp4" && !isIPv4) || (r.Network == "tcp6" && isIPv4) {
+			continue
+		}
+		return ip
+	}
+	return nil
+}
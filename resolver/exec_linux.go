@@ -0,0 +1,16 @@
+package resolver
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killGroup starts the command in a process group of its own, and kills the
+// whole group once the command times out, so that no child left holding its
+// output keeps it running
+func killGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
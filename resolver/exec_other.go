@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package resolver
+
+import "os/exec"
+
+// killGroup only kills the command itself once it times out, its children
+// being cut off by the wait delay instead
+func killGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,431 @@
+package resolver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kerti/cloudflare-ddns/logger"
+)
+
+const (
+	natPMPVersion           = 0
+	natPMPOpExternalAddress = 0
+	pcpVersion              = 2
+	pcpOpMap                = 1
+	pcpProtocolUDP          = 17
+
+	// pcpProbeLifetime is the lifetime of the mapping made to learn the
+	// external address over PCP, which is deleted right away anyway
+	pcpProbeLifetime = 60
+
+	ssdpSearchTarget = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+	// routeFlagGateway marks routes going through a gateway, see linux/route.h
+	routeFlagGateway = 0x2
+)
+
+var (
+	// natPMPPort is the port NAT-PMP and PCP gateways listen on
+	natPMPPort = 5351
+	// ssdpAddr is the address SSDP searches are sent to
+	ssdpAddr = "239.255.255.250:1900"
+	// gatewayTimeout is the timeout of the first attempt of a UDP request,
+	// doubled on every retry
+	gatewayTimeout = 250 * time.Millisecond
+	// gatewayAttempts is how many times a UDP request is sent
+	gatewayAttempts = 3
+	// ssdpTimeout is how long SSDP responses are waited for
+	ssdpTimeout = 2 * time.Second
+	// upnpClient fetches the device description and performs the SOAP call
+	upnpClient = &http.Client{Timeout: 5 * time.Second}
+
+	upnpServiceTypes = []string{
+		"urn:schemas-upnp-org:service:WANIPConnection:",
+		"urn:schemas-upnp-org:service:WANPPPConnection:",
+	}
+)
+
+// getExternalIPGateway asks the gateway for its external address, over
+// NAT-PMP or PCP first, and over UPnP IGD otherwise
+func (r *Resolver) getExternalIPGateway() (net.IP, error) {
+	gateway, err := r.gatewayAddress()
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	ip, err := r.natPMPExternalAddress(gateway)
+	if err != nil {
+		logger.Debug("[RESOLVER] [%s] NAT-PMP/PCP failed (%s), trying UPnP IGD", gateway, err.Error())
+		ip, err = r.upnpExternalAddress(gateway)
+	}
+	if err != nil {
+		err = fmt.Errorf("gateway [%s] did not tell its external address: %s", gateway, err.Error())
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	if !isPublic(ip) {
+		err = fmt.Errorf("gateway [%s] reports [%s] as its external address, it is behind another NAT", gateway, ip)
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	logger.Debug("[RESOLVER] [%s] Detected external IP: %v", gateway, ip)
+	return ip, nil
+}
+
+// gatewayAddress returns the configured gateway, or the default gateway
+func (r *Resolver) gatewayAddress() (net.IP, error) {
+	if len(r.Server) == 0 {
+		return defaultGateway()
+	}
+
+	gateway := net.ParseIP(r.Server)
+	if gateway == nil {
+		return nil, fmt.Errorf("invalid gateway address: [%s]", r.Server)
+	}
+	return gateway, nil
+}
+
+// parseRouteTable reads the gateway of the IPv4 default route from a route
+// table in the format of /proc/net/route, where the addresses are written in
+// the byte order of the host
+func parseRouteTable(table io.Reader, order binary.ByteOrder) (net.IP, error) {
+	scanner := bufio.NewScanner(table)
+	for scanner.Scan() {
+		// interface, destination, gateway, flags, ... mask, all in hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&routeFlagGateway == 0 {
+			continue
+		}
+
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		order.PutUint32(ip, uint32(gateway))
+		return ip.To16(), nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no default gateway found, set the gateway as server")
+}
+
+// exchangeUDP sends the request until a response arrives or the attempts run out
+func exchangeUDP(conn net.Conn, req []byte) ([]byte, error) {
+	buffer := make([]byte, 1500)
+	timeout := gatewayTimeout
+	var err error
+	for attempt := 0; attempt < gatewayAttempts; attempt++ {
+		_, err = conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		var n int
+		n, err = conn.Read(buffer)
+		if err == nil {
+			return buffer[:n], nil
+		}
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return nil, err
+		}
+		timeout *= 2
+	}
+	return nil, err
+}
+
+// natPMPExternalAddress sends a NAT-PMP external address request. PCP servers
+// not speaking NAT-PMP answer with their own version, and are asked over PCP.
+func (r *Resolver) natPMPExternalAddress(gateway net.IP) (net.IP, error) {
+	dialer := &net.Dialer{}
+	err := r.bindDialer(dialer, "udp4")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.Dial("udp4", net.JoinHostPort(gateway.String(), strconv.Itoa(natPMPPort)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	res, err := exchangeUDP(conn, []byte{natPMPVersion, natPMPOpExternalAddress})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) >= 4 && res[0] == pcpVersion {
+		return pcpExternalAddress(conn)
+	}
+
+	if len(res) < 12 || res[0] != natPMPVersion || res[1] != 128+natPMPOpExternalAddress {
+		return nil, fmt.Errorf("invalid NAT-PMP response")
+	}
+	if code := binary.BigEndian.Uint16(res[2:4]); code != 0 {
+		return nil, fmt.Errorf("NAT-PMP gateway responded with result code [%d]", code)
+	}
+
+	return net.IPv4(res[8], res[9], res[10], res[11]), nil
+}
+
+// newPCPMapRequest returns a PCP MAP request for the local UDP port of the
+// connection, letting the gateway pick the external address and port
+func newPCPMapRequest(conn net.Conn, nonce []byte, lifetime uint32) []byte {
+	local := conn.LocalAddr().(*net.UDPAddr)
+	req := make([]byte, 60)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], lifetime)
+	copy(req[8:24], local.IP.To16())
+	copy(req[24:36], nonce)
+	req[36] = pcpProtocolUDP
+	binary.BigEndian.PutUint16(req[40:42], uint16(local.Port))
+	copy(req[44:60], net.IPv4zero.To16())
+	return req
+}
+
+// pcpExternalAddress learns the external address from a short-lived PCP
+// mapping of the local port, which is deleted again right away
+func pcpExternalAddress(conn net.Conn) (net.IP, error) {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+
+	res, err := exchangeUDP(conn, newPCPMapRequest(conn, nonce, pcpProbeLifetime))
+	if err != nil {
+		return nil, err
+	}
+	defer exchangeUDP(conn, newPCPMapRequest(conn, nonce, 0))
+
+	if len(res) < 60 || res[0] != pcpVersion || res[1] != 0x80|pcpOpMap {
+		return nil, fmt.Errorf("invalid PCP response")
+	}
+	if res[3] != 0 {
+		return nil, fmt.Errorf("PCP gateway responded with result code [%d]", res[3])
+	}
+	if !bytes.Equal(res[24:36], nonce) {
+		return nil, fmt.Errorf("PCP response does not match the request")
+	}
+
+	return net.IP(append([]byte{}, res[44:60]...)), nil
+}
+
+// upnpExternalAddress finds the gateway over SSDP and asks its WAN connection
+// service for the external address
+func (r *Resolver) upnpExternalAddress(gateway net.IP) (net.IP, error) {
+	location, err := r.ssdpDiscover(gateway)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := r.upnpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	controlURL, serviceType, err := upnpControlURL(client, location)
+	if err != nil {
+		return nil, err
+	}
+
+	return upnpGetExternalIPAddress(client, controlURL, serviceType)
+}
+
+// upnpClient returns the client talking to the gateway over HTTP, bound to the
+// source address and interface of the resolver if any
+func (r *Resolver) upnpClient() (*http.Client, error) {
+	if !r.isBound() {
+		return upnpClient, nil
+	}
+
+	dialer := &net.Dialer{Timeout: upnpClient.Timeout}
+	err := r.bindDialer(dialer, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}, Timeout: upnpClient.Timeout}, nil
+}
+
+// ssdpDiscover searches for internet gateway devices, and returns the location
+// of the description of the one answering from the gateway address
+func (r *Resolver) ssdpDiscover(gateway net.IP) (string, error) {
+	conn, err := r.listenPacket("udp4")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + ssdpSearchTarget + "\r\n\r\n"
+	_, err = conn.WriteTo([]byte(search), addr)
+	if err != nil {
+		return "", err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buffer := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return "", fmt.Errorf("no internet gateway device found at [%s]", gateway)
+		}
+		if udpAddr, ok := from.(*net.UDPAddr); !ok || !udpAddr.IP.Equal(gateway) {
+			continue
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+
+		location := res.Header.Get("Location")
+		if len(location) > 0 {
+			return location, nil
+		}
+	}
+}
+
+// upnpDevice is a device of a UPnP device description, along with its services
+// and embedded devices
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// findService returns the control URL and type of the WAN connection service
+func (d upnpDevice) findService() (string, string) {
+	for _, service := range d.Services {
+		for _, serviceType := range upnpServiceTypes {
+			if strings.HasPrefix(service.ServiceType, serviceType) {
+				return service.ControlURL, service.ServiceType
+			}
+		}
+	}
+
+	for _, device := range d.Devices {
+		if controlURL, serviceType := device.findService(); len(controlURL) > 0 {
+			return controlURL, serviceType
+		}
+	}
+	return "", ""
+}
+
+// upnpControlURL fetches the device description, and returns the absolute
+// control URL and the type of the WAN connection service
+func upnpControlURL(client *http.Client, location string) (string, string, error) {
+	res, err := client.Get(location)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("device description responded with HTTP/%v", res.StatusCode)
+	}
+
+	var description struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&description)
+	if err != nil {
+		return "", "", err
+	}
+
+	controlURL, serviceType := description.Device.findService()
+	if len(controlURL) == 0 {
+		return "", "", fmt.Errorf("no WAN connection service found at [%s]", location)
+	}
+
+	base := location
+	if len(description.URLBase) > 0 {
+		base = description.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", "", err
+	}
+	ref, err := url.Parse(controlURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	return baseURL.ResolveReference(ref).String(), serviceType, nil
+}
+
+// upnpGetExternalIPAddress invokes the GetExternalIPAddress action
+func upnpGetExternalIPAddress(client *http.Client, controlURL string, serviceType string) (net.IP, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + serviceType + `"/></s:Body>` +
+		`</s:Envelope>`
+
+	req, err := http.NewRequest("POST", controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+serviceType+`#GetExternalIPAddress"`)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GetExternalIPAddress responded with HTTP/%v", res.StatusCode)
+	}
+
+	var envelope struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	err = xml.Unmarshal(resBody, &envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(envelope.IP))
+	if ip == nil {
+		return nil, fmt.Errorf("cannot parse IP: [%v]", envelope.IP)
+	}
+	return ip, nil
+}
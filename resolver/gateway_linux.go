@@ -0,0 +1,18 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+)
+
+// defaultGateway reads the gateway of the IPv4 default route
+func defaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseRouteTable(file, binary.NativeEndian)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package resolver
+
+import (
+	"fmt"
+	"net"
+)
+
+// defaultGateway cannot be discovered on this platform
+func defaultGateway() (net.IP, error) {
+	return nil, fmt.Errorf("cannot discover the default gateway on this platform, set the gateway as server")
+}
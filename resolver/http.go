@@ -0,0 +1,96 @@
+package resolver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTimeout bounds a whole query, or a command of an exec resolver
+	defaultTimeout = 10 * time.Second
+	// defaultConnectTimeout bounds establishing the connection to a provider
+	defaultConnectTimeout = 5 * time.Second
+	// defaultMaxResponseSize is the largest response read from a provider,
+	// which is plenty for an IP address wrapped in a web page
+	defaultMaxResponseSize = 1 << 20
+	// defaultUserAgent identifies the queries to the providers
+	defaultUserAgent = "cloudflare-ddns"
+)
+
+// newRequest builds the request to the provider, with the configured method,
+// body, headers and credentials
+func (r *Resolver) newRequest() (*http.Request, error) {
+	method := strings.ToUpper(r.Method)
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if len(r.Body) > 0 {
+		body = strings.NewReader(r.Body)
+	}
+
+	req, err := http.NewRequest(method, r.URL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := r.UserAgent
+	if len(userAgent) == 0 {
+		userAgent = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	for name, value := range r.Headers {
+		req.Header.Set(name, value)
+	}
+
+	switch {
+	case len(r.Token) > 0:
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	case len(r.Username) > 0:
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+
+	return req, nil
+}
+
+// limitedBody fails reading a response body larger than the limit, instead of
+// silently cutting it off
+type limitedBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+}
+
+func (r *Resolver) limitBody(body io.ReadCloser) io.ReadCloser {
+	limit := r.MaxResponseSize
+	if limit <= 0 {
+		limit = defaultMaxResponseSize
+	}
+	return &limitedBody{ReadCloser: body, limit: limit, remaining: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.tooLarge()
+	}
+
+	// read one byte past the limit to tell whether there is more
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n - 1, b.tooLarge()
+	}
+	return n, err
+}
+
+func (b *limitedBody) tooLarge() error {
+	return fmt.Errorf("response is larger than [%d] bytes", b.limit)
+}
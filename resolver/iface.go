@@ -0,0 +1,194 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kerti/cloudflare-ddns/config"
+	"github.com/kerti/cloudflare-ddns/logger"
+)
+
+const (
+	// SelectionStable picks a stable IPv6 address, e.g. one derived from the
+	// hardware address, over a temporary one
+	SelectionStable = "stable"
+	// SelectionTemporary picks a temporary (privacy extension) IPv6 address
+	SelectionTemporary = "temporary"
+
+	// ReservedCGNAT is the kind of the shared address space carriers number
+	// their customers from when several of them share a single external IP
+	ReservedCGNAT = "CGNAT"
+)
+
+// reservedNetworks lists the kinds of addresses an external IP never is
+var reservedNetworks = []struct {
+	Kind     string
+	Networks []*net.IPNet
+}{
+	{"private", parseNetworks("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")},
+	{ReservedCGNAT, parseNetworks("100.64.0.0/10")},
+	{"loopback", parseNetworks("127.0.0.0/8", "::1/128")},
+	{"link-local", parseNetworks("169.254.0.0/16", "fe80::/10")},
+	{"documentation", parseNetworks("192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32", "3fff::/20")},
+	{"multicast", parseNetworks("224.0.0.0/4", "ff00::/8")},
+	{"unspecified", parseNetworks("0.0.0.0/8", "::/128")},
+}
+
+// ifaceAddr is an address of a network interface, along with its flags where
+// the platform tells them
+type ifaceAddr struct {
+	IP         net.IP
+	Temporary  bool
+	Deprecated bool
+	Tentative  bool
+}
+
+// interfaceAddrs returns the addresses of the named interface. It is a
+// variable, so that tests can do without real interfaces.
+var interfaceAddrs = func(name string) ([]ifaceAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	flags, err := addressFlags(name)
+	if err != nil {
+		logger.Warn("[RESOLVER] Cannot read the address flags of interface [%s]: %s", name, err.Error())
+	}
+
+	result := make([]ifaceAddr, 0)
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		a := ifaceAddr{IP: ipNet.IP}
+		if f, ok := flags[ipNet.IP.String()]; ok {
+			a.Temporary, a.Deprecated, a.Tentative = f.Temporary, f.Deprecated, f.Tentative
+		}
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+// parseNetworks parses networks known to be valid
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	result, _ := config.Networks(cidrs)
+	return result
+}
+
+// Reserved returns the kind of reserved address the IP is, such as private,
+// CGNAT or loopback, or an empty string if it can be an external IP
+func Reserved(ip net.IP) string {
+	for _, reserved := range reservedNetworks {
+		for _, network := range reserved.Networks {
+			if network.Contains(ip) {
+				return reserved.Kind
+			}
+		}
+	}
+	return ""
+}
+
+// isPublic checks whether an address can be the external IP
+func isPublic(ip net.IP) bool {
+	return len(Reserved(ip)) == 0
+}
+
+// InterfaceAddrs returns the addresses of all network interfaces by name
+func InterfaceAddrs() (map[string][]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]net.IP)
+	for _, iface := range ifaces {
+		addrs, err := interfaceAddrs(iface.Name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			result[iface.Name] = append(result[iface.Name], addr.IP)
+		}
+	}
+	return result, nil
+}
+
+// getExternalIPInterface reads the external IP from the addresses of the
+// configured interface
+func (r *Resolver) getExternalIPInterface() (net.IP, error) {
+	if len(r.Interface) == 0 {
+		err := fmt.Errorf("interface resolver [%s] requires an interface", r.Name)
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	addrs, err := interfaceAddrs(r.Interface)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	ip, err := r.selectAddress(addrs)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	logger.Debug("[RESOLVER] [%s] Detected external IP: %v", r.Interface, ip)
+	return ip, nil
+}
+
+// selectAddress picks the external IP out of the addresses of the interface.
+// IPv6 addresses are only considered when the resolver is forced to tcp6.
+func (r *Resolver) selectAddress(addrs []ifaceAddr) (net.IP, error) {
+	var prefix *net.IPNet
+	if len(r.Prefix) > 0 {
+		var err error
+		_, prefix, err = net.ParseCIDR(r.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix for interface [%s]: [%s]", r.Interface, r.Prefix)
+		}
+	}
+
+	selection := strings.ToLower(r.Selection)
+	switch selection {
+	case "":
+		selection = SelectionStable
+	case SelectionStable, SelectionTemporary:
+	default:
+		return nil, fmt.Errorf("unsupported address selection for interface [%s]: [%s]", r.Interface, r.Selection)
+	}
+
+	family := "IPv4"
+	if r.IsIPv6() {
+		family = "IPv6"
+	}
+
+	for _, a := range addrs {
+		isIPv4 := a.IP.To4() != nil
+		if isIPv4 == r.IsIPv6() || !isPublic(a.IP) || a.Deprecated || a.Tentative {
+			continue
+		}
+		if prefix != nil && !prefix.Contains(a.IP) {
+			continue
+		}
+		if !isIPv4 && a.Temporary != (selection == SelectionTemporary) {
+			continue
+		}
+		return a.IP.To16(), nil
+	}
+
+	if r.IsIPv6() {
+		family = selection + " " + family
+	}
+	return nil, fmt.Errorf("no usable %s address on interface [%s]", family, r.Interface)
+}
@@ -0,0 +1,60 @@
+package resolver
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// address flags as found in /proc/net/if_inet6, see linux/if_addr.h
+const (
+	ifaFlagTemporary  = 0x01
+	ifaFlagDADFailed  = 0x08
+	ifaFlagDeprecated = 0x20
+	ifaFlagTentative  = 0x40
+)
+
+// addressFlags reads the flags of the IPv6 addresses of the named interface
+func addressFlags(name string) (map[string]ifaceAddr, error) {
+	result := make(map[string]ifaceAddr)
+	file, err := os.Open("/proc/net/if_inet6")
+	if err != nil {
+		// no IPv6 support at all
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return result, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// address, index, prefix length, scope, flags, name
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[5] != name {
+			continue
+		}
+
+		raw, err := hex.DecodeString(fields[0])
+		if err != nil || len(raw) != net.IPv6len {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[4], 16, 32)
+		if err != nil {
+			continue
+		}
+
+		ip := net.IP(raw)
+		result[ip.String()] = ifaceAddr{
+			IP:         ip,
+			Temporary:  flags&ifaFlagTemporary != 0,
+			Deprecated: flags&ifaFlagDeprecated != 0,
+			Tentative:  flags&(ifaFlagTentative|ifaFlagDADFailed) != 0,
+		}
+	}
+
+	return result, scanner.Err()
+}
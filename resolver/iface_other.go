@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package resolver
+
+// addressFlags is not available on this platform, so all addresses are taken
+// to be stable and preferred
+func addressFlags(name string) (map[string]ifaceAddr, error) {
+	return make(map[string]ifaceAddr), nil
+}
@@ -0,0 +1,243 @@
+package resolver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is a single step of a JSON path, selecting a key, an index,
+// all children, or the children matching a filter
+type jsonPathStep struct {
+	key       string
+	index     int
+	isIndex   bool
+	wildcard  bool
+	recursive bool
+	filter    func(value interface{}) bool
+}
+
+// parseJSONPath parses the supported subset of JSONPath: an optional `$` root,
+// dotted keys (`.data.ip`), quoted keys (`['my key']`), array indexes (`[0]`,
+// `[-1]`), wildcards (`.*`, `[*]`), recursive descent (`..ip`) and simple
+// filters (`[?(@.type=='ipv4')]`). A path may leave out the root and the
+// leading dot, as in `data.ips[0]`.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	steps := make([]jsonPathStep, 0)
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	first := true
+	for len(rest) > 0 {
+		step := jsonPathStep{}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			rest = rest[2:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+		case strings.HasPrefix(rest, "["):
+		case !first:
+			return nil, fmt.Errorf("invalid JSON path [%s]: unexpected [%s]", path, rest)
+		}
+		first = false
+
+		if strings.HasPrefix(rest, "[") {
+			end := closingBracket(rest)
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSON path [%s]: unclosed bracket", path)
+			}
+			err := step.parseBracket(strings.TrimSpace(rest[1:end]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON path [%s]: %s", path, err.Error())
+			}
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			step.key = rest[:end]
+			if len(step.key) == 0 {
+				return nil, fmt.Errorf("invalid JSON path [%s]: empty key", path)
+			}
+			step.wildcard = step.key == "*"
+			rest = rest[end:]
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// closingBracket returns the index of the bracket closing the one the text
+// starts with, skipping quoted strings
+func closingBracket(text string) int {
+	var quote rune
+	depth := 0
+	for i, c := range text {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// unquote returns the content of a single or double quoted string
+func unquote(text string) (string, bool) {
+	if len(text) >= 2 && (text[0] == '\'' || text[0] == '"') && text[len(text)-1] == text[0] {
+		return text[1 : len(text)-1], true
+	}
+	return text, false
+}
+
+func (s *jsonPathStep) parseBracket(content string) error {
+	if content == "*" {
+		s.wildcard = true
+		return nil
+	}
+	if key, ok := unquote(content); ok {
+		s.key = key
+		return nil
+	}
+	if index, err := strconv.Atoi(content); err == nil {
+		s.index, s.isIndex = index, true
+		return nil
+	}
+	if strings.HasPrefix(content, "?(") && strings.HasSuffix(content, ")") {
+		return s.parseFilter(strings.TrimSpace(content[2 : len(content)-1]))
+	}
+	return fmt.Errorf("unsupported selector [%s]", content)
+}
+
+// parseFilter parses `@.path`, `@.path == literal` and `@.path != literal`
+func (s *jsonPathStep) parseFilter(expr string) error {
+	operator := ""
+	left, right := expr, ""
+	for _, op := range []string{"==", "!="} {
+		if i := indexUnquoted(expr, op); i >= 0 {
+			operator = op
+			left, right = strings.TrimSpace(expr[:i]), strings.TrimSpace(expr[i+len(op):])
+			break
+		}
+	}
+
+	if !strings.HasPrefix(left, "@") {
+		return fmt.Errorf("unsupported filter [%s]", expr)
+	}
+	steps, err := parseJSONPath(left[1:])
+	if err != nil {
+		return err
+	}
+	literal, _ := unquote(right)
+
+	s.filter = func(value interface{}) bool {
+		matches := evalJSONPath(value, steps)
+		switch operator {
+		case "==":
+			return len(matches) > 0 && fmt.Sprint(matches[0]) == literal
+		case "!=":
+			return len(matches) == 0 || fmt.Sprint(matches[0]) != literal
+		default:
+			return len(matches) > 0
+		}
+	}
+	return nil
+}
+
+// children returns the values of an object, in key order, or the elements
+// of an array
+func children(value interface{}) []interface{} {
+	result := make([]interface{}, 0)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			result = append(result, v[key])
+		}
+	case []interface{}:
+		result = append(result, v...)
+	}
+	return result
+}
+
+// descendants returns the value and everything nested in it, depth first
+func descendants(value interface{}) []interface{} {
+	result := []interface{}{value}
+	for _, child := range children(value) {
+		result = append(result, descendants(child)...)
+	}
+	return result
+}
+
+func (s jsonPathStep) apply(value interface{}) []interface{} {
+	switch {
+	case s.wildcard:
+		return children(value)
+	case s.filter != nil:
+		result := make([]interface{}, 0)
+		for _, child := range children(value) {
+			if s.filter(child) {
+				result = append(result, child)
+			}
+		}
+		return result
+	case s.isIndex:
+		array, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		index := s.index
+		if index < 0 {
+			index += len(array)
+		}
+		if index < 0 || index >= len(array) {
+			return nil
+		}
+		return []interface{}{array[index]}
+	default:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if child, ok := object[s.key]; ok {
+			return []interface{}{child}
+		}
+		return nil
+	}
+}
+
+// evalJSONPath returns all values the steps select in the document
+func evalJSONPath(doc interface{}, steps []jsonPathStep) []interface{} {
+	nodes := []interface{}{doc}
+	for _, step := range steps {
+		next := make([]interface{}, 0)
+		for _, node := range nodes {
+			if step.recursive {
+				for _, descendant := range descendants(node) {
+					next = append(next, step.apply(descendant)...)
+				}
+			} else {
+				next = append(next, step.apply(node)...)
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
@@ -1,25 +1,65 @@
 package resolver
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/miekg/dns"
 	"github.com/spf13/viper"
 )
 
 // Resolver represents a generic resolver
 type Resolver struct {
-	Name       string
-	Type       string
-	URL        string
-	JSONPath   string
-	HTTPClient *http.Client
+	Name            string
+	Type            string
+	URL             string
+	JSONPath        string
+	Pattern         string
+	XPath           string
+	Network         string
+	Method          string
+	Body            string
+	Headers         map[string]string
+	Username        string
+	Password        string
+	Token           string
+	UserAgent       string
+	MaxResponseSize int64
+	ConnectTimeout  time.Duration
+	NoVerify        bool
+	CABundle        string
+	Pins            []string
+	MinTLSVersion   string
+	BindAddress     string
+	BindInterface   string
+	Server          string
+	Query           string
+	QueryType       string
+	QueryClass      string
+	Interface       string
+	Selection       string
+	Prefix          string
+	Command         string
+	Args            []string
+	Env             []string
+	Timeout         time.Duration
+	HTTPClient      *http.Client
+	DNSClient       *dns.Client
+}
+
+// Uplink is a named WAN connection, along with the resolvers telling its
+// external IP
+type Uplink struct {
+	Name      string
+	Resolvers []Resolver
 }
 
 // Get constructs all generic resolvers
@@ -27,9 +67,55 @@ func Get() ([]Resolver, error) {
 	resolvers := make([]Resolver, 0)
 	viper.UnmarshalKey("resolver.list", &resolvers)
 
+	if viper.GetBool("resolver.noVerify") {
+		logger.Warn("[RESOLVER] resolver.noVerify is no longer supported, set noVerify on the resolvers that need it.")
+	}
+
+	return initAll(resolvers)
+}
+
+// GetUplinks constructs the resolvers of all uplinks
+func GetUplinks() ([]Uplink, error) {
+	uplinks := make([]Uplink, 0)
+	viper.UnmarshalKey("uplinks", &uplinks)
+
+	seen := make(map[string]bool)
+	for i, uplink := range uplinks {
+		if len(uplink.Name) == 0 {
+			err := fmt.Errorf("uplink entry without a name")
+			logger.Error(err.Error())
+			return nil, err
+		}
+		if seen[uplink.Name] {
+			err := fmt.Errorf("duplicate uplink: [%s]", uplink.Name)
+			logger.Error(err.Error())
+			return nil, err
+		}
+		seen[uplink.Name] = true
+		if len(uplink.Resolvers) == 0 {
+			err := fmt.Errorf("uplink [%s] has no resolvers", uplink.Name)
+			logger.Error(err.Error())
+			return nil, err
+		}
+
+		resolvers, err := initAll(uplink.Resolvers)
+		if err != nil {
+			return nil, err
+		}
+		uplinks[i].Resolvers = resolvers
+	}
+
+	return uplinks, nil
+}
+
+func initAll(resolvers []Resolver) ([]Resolver, error) {
 	result := make([]Resolver, 0)
 	for _, res := range resolvers {
-		res.Init()
+		err := res.Init()
+		if err != nil {
+			logger.Error(err.Error())
+			return nil, err
+		}
 		result = append(result, res)
 	}
 
@@ -37,18 +123,119 @@ func Get() ([]Resolver, error) {
 }
 
 // Init initializes the resolver
-func (r *Resolver) Init() {
-	logger.Debug("[RESOLVER] Initializing for [%s]", r.URL)
+func (r *Resolver) Init() error {
+	target := r.URL
+	switch r.Type {
+	case "dns", "stun":
+		target = r.Server
+	case "interface":
+		target = r.Interface
+	case "exec":
+		target = r.Command
+	case "gateway":
+		target = r.Server
+		if len(target) == 0 {
+			target = "default gateway"
+		}
+	}
+	logger.Debug("[RESOLVER] Initializing for [%s]", target)
+	tlsConfig, err := r.tlsConfig()
+	if err != nil {
+		return err
+	}
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+
+	connectTimeout := r.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	err = r.bindDialer(dialer, "tcp")
+	if err != nil {
+		return err
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+
+	// force the address family if one is configured
+	switch r.Network {
+	case "tcp4", "tcp6":
+		network := r.Network
+		transport.DialContext = func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	case "", "tcp":
+	default:
+		logger.Warn("[RESOLVER] Unsupported network [%s] for [%s], using default", r.Network, r.URL)
+	}
+
+	// never let a hanging provider block the worker
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
 	r.HTTPClient = &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: viper.GetBool("resolver.noVerify")},
-		},
+		Transport: transport,
+		Timeout:   timeout,
+	}
+	return r.initDNS()
+}
+
+// IsIPv6 returns true if the resolver is forced to dial over IPv6
+func (r *Resolver) IsIPv6() bool {
+	return r.Network == "tcp6"
+}
+
+// IsRateLimited returns true if the resolver should not be queried more than
+// once every few minutes. STUN servers are happy to be queried often, and
+// reading a local interface or asking the gateway costs nothing.
+func (r *Resolver) IsRateLimited() bool {
+	return r.Type != "stun" && r.Type != "interface" && r.Type != "gateway"
+}
+
+// udpNetwork returns the network of the resolvers speaking UDP, in the forced
+// address family if one is configured
+func (r *Resolver) udpNetwork() string {
+	switch r.Network {
+	case "tcp4", "tcp6":
+		return strings.Replace(r.Network, "tcp", "udp", 1)
+	default:
+		return "udp"
 	}
 }
 
 // GetExternalIP invokes the URL and fetches the external IP returned
 func (r *Resolver) GetExternalIP() (net.IP, error) {
-	response, err := r.HTTPClient.Get(r.URL)
+	var getExternalIP func() (net.IP, error)
+	switch r.Type {
+	case "dns":
+		getExternalIP = r.getExternalIPDNS
+	case "stun":
+		getExternalIP = r.getExternalIPSTUN
+	case "interface":
+		getExternalIP = r.getExternalIPInterface
+	case "gateway":
+		getExternalIP = r.getExternalIPGateway
+	case "exec":
+		getExternalIP = r.getExternalIPExec
+	}
+	if getExternalIP != nil {
+		ip, err := getExternalIP()
+		if err != nil {
+			return nil, err
+		}
+		return r.checkFamily(ip)
+	}
+
+	request, err := r.newRequest()
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	response, err := r.HTTPClient.Do(request)
 	if err != nil {
 		logger.Error(err.Error())
 		return nil, err
@@ -60,40 +247,77 @@ func (r *Resolver) GetExternalIP() (net.IP, error) {
 		return nil, err
 	}
 
+	response.Body = r.limitBody(response.Body)
 	defer response.Body.Close()
 
-	if response.StatusCode == http.StatusOK {
-		switch r.Type {
-		case "text":
-			return r.readIPText(*response)
-		case "json":
-			return r.readIPJSON(*response)
-		default:
-			err = fmt.Errorf("unsupported resolver type: [%v]", r.Type)
-			logger.Error(err.Error())
-			return nil, err
-		}
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("provider responded with HTTP/%v", response.StatusCode)
+		logger.Error(err.Error())
+		return nil, err
 	}
 
-	err = fmt.Errorf("provider responded with HTTP/%v", response.StatusCode)
-	logger.Error(err.Error())
-	return nil, err
+	var ip net.IP
+	switch r.Type {
+	case "text":
+		ip, err = r.readIPText(*response)
+	case "json":
+		ip, err = r.readIPJSON(*response)
+	case "regex":
+		ip, err = r.readIPRegex(*response)
+	case "xml", "html":
+		ip, err = r.readIPMarkup(*response)
+	default:
+		err = fmt.Errorf("unsupported resolver type: [%v]", r.Type)
+		logger.Error(err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r.checkFamily(ip)
 }
 
-func (r *Resolver) readIPText(response http.Response) (net.IP, error) {
-	bodyBytes, err := r.getResponseBodyBytes(response)
-	if err != nil {
+func (r *Resolver) checkFamily(ip net.IP) (net.IP, error) {
+	isIPv4 := ip.To4() != nil
+	if (r.Network == "tcp4" && !isIPv4) || (r.Network == "tcp6" && isIPv4) {
+		err := fmt.Errorf("provider returned [%v] over %s", ip, r.Network)
+		logger.Error(err.Error())
 		return nil, err
 	}
 
-	reg, err := regexp.Compile("[^0-9\\.]+")
+	return ip, nil
+}
+
+func findIP(text string) net.IP {
+	isIPChar := func(c rune) bool {
+		return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') || c == '.' || c == ':'
+	}
+
+	for _, field := range strings.FieldsFunc(text, func(c rune) bool { return !isIPChar(c) }) {
+		// a label such as "ip:1.2.3.4" leaves a colon before the IP, and one
+		// ending in hex letters such as "Interface:1.2.3.4" even those
+		candidates := []string{field, strings.Trim(field, ":")}
+		if i := strings.LastIndex(field, ":"); i >= 0 && strings.Contains(field[i:], ".") {
+			candidates = append(candidates, field[i+1:])
+		}
+		for _, candidate := range candidates {
+			parsedIP := net.ParseIP(candidate)
+			if parsedIP != nil {
+				return parsedIP
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Resolver) readIPText(response http.Response) (net.IP, error) {
+	bodyBytes, err := r.getResponseBodyBytes(response)
 	if err != nil {
-		logger.Error(err.Error())
 		return nil, err
 	}
 
-	ipString := reg.ReplaceAllString(string(bodyBytes), "")
-	parsedIP := net.ParseIP(ipString)
+	parsedIP := findIP(string(bodyBytes))
 	if parsedIP == nil {
 		err = fmt.Errorf("cannot parse IP: [%v]", string(bodyBytes))
 		logger.Error(err.Error())
@@ -115,12 +339,12 @@ func (r *Resolver) getResponseBodyBytes(response http.Response) ([]byte, error)
 }
 
 func (r *Resolver) readIPJSON(response http.Response) (net.IP, error) {
-	kvMap, err := r.getResponseJSONMap(response)
+	doc, err := r.getResponseJSON(response)
 	if err != nil {
 		return nil, err
 	}
 
-	ipString, err := r.findIPString(kvMap)
+	ipString, err := r.findIPString(doc)
 	if err != nil {
 		return nil, err
 	}
@@ -136,25 +360,39 @@ func (r *Resolver) readIPJSON(response http.Response) (net.IP, error) {
 	return parsedIP, nil
 }
 
-func (r *Resolver) getResponseJSONMap(response http.Response) (map[string]interface{}, error) {
+func (r *Resolver) getResponseJSON(response http.Response) (interface{}, error) {
 	bodyBytes, err := r.getResponseBodyBytes(response)
 	if err != nil {
 		logger.Error(err.Error())
 		return nil, err
 	}
 
-	var kvMap map[string]interface{}
-	err = json.Unmarshal(bodyBytes, &kvMap)
+	var doc interface{}
+	err = json.Unmarshal(bodyBytes, &doc)
 	if err != nil {
 		logger.Error(err.Error())
 		return nil, err
 	}
 
-	return kvMap, nil
+	return doc, nil
 }
 
-func (r *Resolver) findIPString(kvMap map[string]interface{}) (string, error) {
-	ipObj := kvMap[r.JSONPath]
+func (r *Resolver) findIPString(doc interface{}) (string, error) {
+	var ipObj interface{}
+	if kvMap, ok := doc.(map[string]interface{}); ok && kvMap[r.JSONPath] != nil {
+		// a top level key always wins, even if it reads like a path
+		ipObj = kvMap[r.JSONPath]
+	} else {
+		steps, err := parseJSONPath(r.JSONPath)
+		if err != nil {
+			logger.Error(err.Error())
+			return "", err
+		}
+		if matches := evalJSONPath(doc, steps); len(matches) > 0 {
+			ipObj = matches[0]
+		}
+	}
+
 	if ipObj == nil {
 		err := fmt.Errorf("IP address not found at path [%s]", r.JSONPath)
 		logger.Error(err.Error())
@@ -170,3 +408,81 @@ func (r *Resolver) findIPString(kvMap map[string]interface{}) (string, error) {
 
 	return ipString, nil
 }
+
+// readIPRegex reads the IP matched by the `ip` named capture group of the
+// pattern, or by its first group if it has no such group
+func (r *Resolver) readIPRegex(response http.Response) (net.IP, error) {
+	pattern, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	bodyBytes, err := r.getResponseBodyBytes(response)
+	if err != nil {
+		return nil, err
+	}
+
+	match := pattern.FindSubmatch(bodyBytes)
+	if match == nil {
+		err = fmt.Errorf("IP address not found with pattern [%s]", r.Pattern)
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	group := 0
+	if i := pattern.SubexpIndex("ip"); i > 0 {
+		group = i
+	} else if len(match) > 1 {
+		group = 1
+	}
+
+	ipString := strings.TrimSpace(string(match[group]))
+	parsedIP := net.ParseIP(ipString)
+	if parsedIP == nil {
+		err = fmt.Errorf("cannot parse IP: [%v]", ipString)
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	logger.Debug("[RESOLVER] [%s] Detected external IP: %v", r.URL, parsedIP)
+	return parsedIP, nil
+}
+
+// readIPMarkup reads the IP from the first node the XPath selects in an XML
+// or HTML response
+func (r *Resolver) readIPMarkup(response http.Response) (net.IP, error) {
+	steps, err := parseXPath(r.XPath)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	var root *markupNode
+	if r.Type == "html" {
+		root, err = parseHTML(response.Body)
+	} else {
+		root, err = parseXML(response.Body)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	matches := evalXPath(root, steps)
+	if len(matches) == 0 {
+		err = fmt.Errorf("IP address not found at path [%s]", r.XPath)
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	parsedIP := findIP(matches[0])
+	if parsedIP == nil {
+		err = fmt.Errorf("cannot parse IP: [%v]", strings.TrimSpace(matches[0]))
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	logger.Debug("[RESOLVER] [%s] Detected external IP: %v", r.URL, parsedIP)
+	return parsedIP, nil
+}
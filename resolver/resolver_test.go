@@ -2,15 +2,28 @@ package resolver
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kerti/cloudflare-ddns/config"
 	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -53,6 +66,89 @@ var (
 			result:   net.ParseIP("1.2.3.4"),
 			err:      nil,
 		},
+		{
+			name:     "validIpAddressWithLabel",
+			response: "Your IP: 1.2.3.4",
+			result:   net.ParseIP("1.2.3.4"),
+			err:      nil,
+		},
+		{
+			name:     "validIPv6Address",
+			response: "2001:db8::1\n",
+			result:   net.ParseIP("2001:db8::1"),
+			err:      nil,
+		},
+		{
+			name:     "validIpAddressWithLabelWithoutSpace",
+			response: "ip:1.2.3.4",
+			result:   net.ParseIP("1.2.3.4"),
+			err:      nil,
+		},
+		{
+			name:     "validIpAddressWithLongLabelWithoutSpace",
+			response: "Current IP Address:1.2.3.4",
+			result:   net.ParseIP("1.2.3.4"),
+			err:      nil,
+		},
+		{
+			name:     "validIpAddressWithHexLabelWithoutSpace",
+			response: "WAN Interface:1.2.3.4",
+			result:   net.ParseIP("1.2.3.4"),
+			err:      nil,
+		},
+		{
+			name:     "validIPv6AddressWithLabelWithoutSpace",
+			response: "ip:2001:db8::1:",
+			result:   net.ParseIP("2001:db8::1"),
+			err:      nil,
+		},
+	}
+
+	checkFamilyTestCases = []struct {
+		name     string
+		network  string
+		ip       net.IP
+		errIsNil bool
+		errMsg   string
+	}{
+		{
+			name:     "anyNetworkIPv4",
+			network:  "",
+			ip:       net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "anyNetworkIPv6",
+			network:  "",
+			ip:       net.ParseIP("2001:db8::1"),
+			errIsNil: true,
+		},
+		{
+			name:     "tcp4IPv4",
+			network:  "tcp4",
+			ip:       net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "tcp4IPv6",
+			network:  "tcp4",
+			ip:       net.ParseIP("2001:db8::1"),
+			errIsNil: false,
+			errMsg:   "provider returned [2001:db8::1] over tcp4",
+		},
+		{
+			name:     "tcp6IPv6",
+			network:  "tcp6",
+			ip:       net.ParseIP("2001:db8::1"),
+			errIsNil: true,
+		},
+		{
+			name:     "tcp6IPv4",
+			network:  "tcp6",
+			ip:       net.ParseIP("1.2.3.4"),
+			errIsNil: false,
+			errMsg:   "provider returned [1.2.3.4] over tcp6",
+		},
 	}
 
 	readIPJSONTestCases = []struct {
@@ -111,6 +207,233 @@ var (
 			errIsNil: true,
 			errMsg:   "",
 		},
+		{
+			name:     "topLevelKeyWithDots",
+			jsonPath: "ip.address",
+			response: `{"ip.address": "1.2.3.4"}`,
+			result:   net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "dottedPath",
+			jsonPath: "data.ip",
+			response: `{"data": {"ip": "1.2.3.4"}}`,
+			result:   net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "rootedPath",
+			jsonPath: "$.data['client ip']",
+			response: `{"data": {"client ip": "1.2.3.4"}}`,
+			result:   net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "arrayIndex",
+			jsonPath: "ips[1]",
+			response: `{"ips": ["1.2.3.4", "5.6.7.8"]}`,
+			result:   net.ParseIP("5.6.7.8"),
+			errIsNil: true,
+		},
+		{
+			name:     "negativeArrayIndex",
+			jsonPath: "ips[-1]",
+			response: `{"ips": ["1.2.3.4", "5.6.7.8"]}`,
+			result:   net.ParseIP("5.6.7.8"),
+			errIsNil: true,
+		},
+		{
+			name:     "topLevelArray",
+			jsonPath: "$[0].ip",
+			response: `[{"ip": "1.2.3.4"}]`,
+			result:   net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "stringDocument",
+			jsonPath: "$",
+			response: `"1.2.3.4"`,
+			result:   net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "wildcard",
+			jsonPath: "addresses.*.ip",
+			response: `{"addresses": {"wan": {"ip": "1.2.3.4"}}}`,
+			result:   net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "recursiveDescent",
+			jsonPath: "$..ip",
+			response: `{"result": {"client": {"ip": "1.2.3.4"}}}`,
+			result:   net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "filter",
+			jsonPath: "$.addresses[?(@.family=='ipv6')].address",
+			response: `{"addresses": [{"family": "ipv4", "address": "1.2.3.4"}, {"family": "ipv6", "address": "2001:db8::1"}]}`,
+			result:   net.ParseIP("2001:db8::1"),
+			errIsNil: true,
+		},
+		{
+			name:     "indexOutOfRange",
+			jsonPath: "ips[2]",
+			response: `{"ips": ["1.2.3.4", "5.6.7.8"]}`,
+			errMsg:   "IP address not found at path [ips[2]]",
+		},
+		{
+			name:     "invalidPath",
+			jsonPath: "ips[0",
+			response: `{"ips": ["1.2.3.4"]}`,
+			errMsg:   "invalid JSON path [ips[0]: unclosed bracket",
+		},
+		{
+			name:     "unsupportedSelector",
+			jsonPath: "ips[0:2]",
+			response: `{"ips": ["1.2.3.4"]}`,
+			errMsg:   "invalid JSON path [ips[0:2]]: unsupported selector [0:2]",
+		},
+	}
+
+	readIPRegexTestCases = []struct {
+		name     string
+		pattern  string
+		response string
+		result   net.IP
+		errMsg   string
+	}{
+		{
+			name:     "namedGroup",
+			pattern:  `Gateway: (\S+), Address: (?P<ip>[0-9.]+)`,
+			response: "Gateway: 10.0.0.1, Address: 1.2.3.4",
+			result:   net.ParseIP("1.2.3.4"),
+		},
+		{
+			name:     "firstGroup",
+			pattern:  `wan_ip=(\S+)`,
+			response: "lan_ip=192.168.1.1\nwan_ip=2001:db8::1\n",
+			result:   net.ParseIP("2001:db8::1"),
+		},
+		{
+			name:     "wholeMatch",
+			pattern:  `\d+\.\d+\.\d+\.\d+`,
+			response: "Current IP Address: 1.2.3.4",
+			result:   net.ParseIP("1.2.3.4"),
+		},
+		{
+			name:     "noMatch",
+			pattern:  `wan_ip=(\S+)`,
+			response: "lan_ip=192.168.1.1",
+			errMsg:   "IP address not found with pattern [wan_ip=(\\S+)]",
+		},
+		{
+			name:     "invalidValue",
+			pattern:  `wan_ip=(\S+)`,
+			response: "wan_ip=unknown",
+			errMsg:   "cannot parse IP: [unknown]",
+		},
+		{
+			name:     "invalidPattern",
+			pattern:  `wan_ip=(`,
+			response: "wan_ip=1.2.3.4",
+			errMsg:   "error parsing regexp: missing closing ): `wan_ip=(`",
+		},
+	}
+
+	readIPMarkupTestCases = []struct {
+		name         string
+		resolverType string
+		xpath        string
+		response     string
+		result       net.IP
+		errMsg       string
+	}{
+		{
+			name:         "xmlAbsolutePath",
+			resolverType: "xml",
+			xpath:        "/response/ip",
+			response:     `<?xml version="1.0"?><response><ip>1.2.3.4</ip></response>`,
+			result:       net.ParseIP("1.2.3.4"),
+		},
+		{
+			name:         "xmlNamespaces",
+			resolverType: "xml",
+			xpath:        "//s:Body/u:Status/NewExternalIPAddress/text()",
+			response:     `<s:Envelope xmlns:s="urn:soap"><s:Body><u:Status xmlns:u="urn:x"><NewExternalIPAddress> 1.2.3.4 </NewExternalIPAddress></u:Status></s:Body></s:Envelope>`,
+			result:       net.ParseIP("1.2.3.4"),
+		},
+		{
+			name:         "xmlAttributePredicate",
+			resolverType: "xml",
+			xpath:        "//address[@family='ipv6']/@value",
+			response:     `<status><address family="ipv4" value="1.2.3.4"/><address family="ipv6" value="2001:db8::1"/></status>`,
+			result:       net.ParseIP("2001:db8::1"),
+		},
+		{
+			name:         "xmlPositionPredicate",
+			resolverType: "xml",
+			xpath:        "/status/address[last()]",
+			response:     `<status><address>1.2.3.4</address><address>5.6.7.8</address></status>`,
+			result:       net.ParseIP("5.6.7.8"),
+		},
+		{
+			name:         "xmlChildPredicate",
+			resolverType: "xml",
+			xpath:        "//interface[name='wan']/ip",
+			response:     `<status><interface><name>lan</name><ip>192.168.1.1</ip></interface><interface><name>wan</name><ip>1.2.3.4</ip></interface></status>`,
+			result:       net.ParseIP("1.2.3.4"),
+		},
+		{
+			name:         "xmlNotFound",
+			resolverType: "xml",
+			xpath:        "/response/address",
+			response:     `<response><ip>1.2.3.4</ip></response>`,
+			errMsg:       "IP address not found at path [/response/address]",
+		},
+		{
+			name:         "xmlInvalidDocument",
+			resolverType: "xml",
+			xpath:        "/response/ip",
+			response:     `<response><ip>1.2.3.4</response>`,
+			errMsg:       "XML syntax error on line 1: element <ip> closed by </response>",
+		},
+		{
+			name:         "htmlScrape",
+			resolverType: "html",
+			xpath:        "//div[contains(@class,'ip-box')]/span[2]",
+			response:     `<html><body><div class="box ip-box"><span>Your IP:</span><span>1.2.3.4</span></div></body></html>`,
+			result:       net.ParseIP("1.2.3.4"),
+		},
+		{
+			name:         "htmlText",
+			resolverType: "html",
+			xpath:        "//p[@id='ip']",
+			response:     `<!DOCTYPE html><title>IP</title><p id=ip>Your address is <b>2001:db8::1</b><p>Bye`,
+			result:       net.ParseIP("2001:db8::1"),
+		},
+		{
+			name:         "htmlInvalidValue",
+			resolverType: "html",
+			xpath:        "//title",
+			response:     `<title>What is my IP?</title>`,
+			errMsg:       "cannot parse IP: [What is my IP?]",
+		},
+		{
+			name:         "invalidXPath",
+			resolverType: "html",
+			xpath:        "//div[@class='ip'",
+			response:     `<div class="ip">1.2.3.4</div>`,
+			errMsg:       "invalid XPath [//div[@class='ip']: unclosed bracket",
+		},
+		{
+			name:         "unsupportedPredicate",
+			resolverType: "html",
+			xpath:        "//div[count(span) > 1]",
+			response:     `<div class="ip">1.2.3.4</div>`,
+			errMsg:       "invalid XPath [//div[count(span) > 1]]: unsupported predicate [count(span) > 1]",
+		},
 	}
 
 	getExternalIPTestCases = []struct {
@@ -208,8 +531,365 @@ var (
 			errMsg:       "unsupported resolver type: [random]",
 		},
 	}
+
+	getExternalIPDNSTestCases = []struct {
+		name       string
+		query      string
+		queryType  string
+		queryClass string
+		network    string
+		result     net.IP
+		errIsNil   bool
+		errMsg     string
+	}{
+		{
+			name:     "openDNS",
+			query:    "myip.opendns.com",
+			result:   net.ParseIP("1.2.3.4"),
+			errIsNil: true,
+		},
+		{
+			name:     "openDNSIPv6",
+			query:    "myip.opendns.com",
+			network:  "tcp6",
+			result:   net.ParseIP("2001:db8::1"),
+			errIsNil: true,
+		},
+		{
+			name:       "cloudflareWhoami",
+			query:      "whoami.cloudflare",
+			queryType:  "TXT",
+			queryClass: "CH",
+			result:     net.ParseIP("5.6.7.8"),
+			errIsNil:   true,
+		},
+		{
+			name:       "wrongClass",
+			query:      "whoami.cloudflare",
+			queryType:  "TXT",
+			queryClass: "IN",
+			result:     nil,
+			errIsNil:   false,
+			errMsg:     "DNS server responded with NXDOMAIN",
+		},
+		{
+			name:      "noAddress",
+			query:     "myip.opendns.com",
+			queryType: "TXT",
+			result:    nil,
+			errIsNil:  false,
+			errMsg:    "no IP in DNS answer for [myip.opendns.com]",
+		},
+		{
+			name:      "unsupportedType",
+			query:     "myip.opendns.com",
+			queryType: "MX",
+			result:    nil,
+			errIsNil:  false,
+			errMsg:    "unsupported DNS query type: [MX]",
+		},
+		{
+			name:     "missingQuery",
+			result:   nil,
+			errIsNil: false,
+			errMsg:   "DNS resolver [test] requires a server and a query",
+		},
+	}
+
+	testInterfaceAddrs = []ifaceAddr{
+		{IP: net.ParseIP("127.0.0.1")},
+		{IP: net.ParseIP("192.168.1.1")},
+		{IP: net.ParseIP("100.64.0.1")},
+		{IP: net.ParseIP("203.0.113.10")},
+		{IP: net.ParseIP("1.2.3.10")},
+		{IP: net.ParseIP("fe80::1")},
+		{IP: net.ParseIP("fd00::1")},
+		{IP: net.ParseIP("2a00:1:1::dead"), Deprecated: true},
+		{IP: net.ParseIP("2a00:1:1::beef"), Tentative: true},
+		{IP: net.ParseIP("2a00:1:1::1")},
+		{IP: net.ParseIP("2a00:1:1::abcd"), Temporary: true},
+		{IP: net.ParseIP("2a00:1:2::1")},
+	}
+
+	selectAddressTestCases = []struct {
+		name      string
+		network   string
+		selection string
+		prefix    string
+		addrs     []ifaceAddr
+		result    net.IP
+		errMsg    string
+	}{
+		{
+			name:   "ipv4",
+			addrs:  testInterfaceAddrs,
+			result: net.ParseIP("1.2.3.10"),
+		},
+		{
+			name:    "ipv6Stable",
+			network: "tcp6",
+			addrs:   testInterfaceAddrs,
+			result:  net.ParseIP("2a00:1:1::1"),
+		},
+		{
+			name:      "ipv6Temporary",
+			network:   "tcp6",
+			selection: "temporary",
+			addrs:     testInterfaceAddrs,
+			result:    net.ParseIP("2a00:1:1::abcd"),
+		},
+		{
+			name:    "ipv6Prefix",
+			network: "tcp6",
+			prefix:  "2a00:1:2::/48",
+			addrs:   testInterfaceAddrs,
+			result:  net.ParseIP("2a00:1:2::1"),
+		},
+		{
+			name:   "privateOnly",
+			addrs:  testInterfaceAddrs[:4],
+			errMsg: "no usable IPv4 address on interface [ppp0]",
+		},
+		{
+			name:      "noTemporary",
+			network:   "tcp6",
+			selection: "temporary",
+			prefix:    "2a00:1:2::/48",
+			addrs:     testInterfaceAddrs,
+			errMsg:    "no usable temporary IPv6 address on interface [ppp0]",
+		},
+		{
+			name:      "unsupportedSelection",
+			selection: "newest",
+			addrs:     testInterfaceAddrs,
+			errMsg:    "unsupported address selection for interface [ppp0]: [newest]",
+		},
+		{
+			name:   "invalidPrefix",
+			prefix: "2001:db8::",
+			addrs:  testInterfaceAddrs,
+			errMsg: "invalid prefix for interface [ppp0]: [2001:db8::]",
+		},
+	}
+
+	getExternalIPExecTestCases = []struct {
+		name    string
+		network string
+		args    []string
+		env     []string
+		timeout time.Duration
+		result  net.IP
+		errMsg  string
+	}{
+		{
+			name:   "ip",
+			args:   []string{"-c", "echo 1.2.3.4"},
+			result: net.ParseIP("1.2.3.4"),
+		},
+		{
+			name:   "firstIP",
+			args:   []string{"-c", "echo 'inet 10.0.0.1/24'; echo 5.6.7.8"},
+			result: net.ParseIP("10.0.0.1"),
+		},
+		{
+			name:    "forcedFamily",
+			network: "tcp6",
+			args:    []string{"-c", "echo 1.2.3.4 2001:db8::1"},
+			result:  net.ParseIP("2001:db8::1"),
+		},
+		{
+			name:   "env",
+			args:   []string{"-c", "echo $WAN_IP"},
+			env:    []string{"WAN_IP=9.8.7.6"},
+			result: net.ParseIP("9.8.7.6"),
+		},
+		{
+			name:   "noIP",
+			args:   []string{"-c", "echo no address"},
+			errMsg: "cannot parse IP: [no address]",
+		},
+		{
+			name:   "exitCode",
+			args:   []string{"-c", "echo 1.2.3.4; echo link down >&2; exit 3"},
+			errMsg: "command [sh] failed: exit status 3 [link down]",
+		},
+		{
+			name:    "timeout",
+			args:    []string{"-c", "sleep 5"},
+			timeout: 50 * time.Millisecond,
+			errMsg:  "command [sh] timed out after 50ms",
+		},
+		{
+			name:    "pipelineTimeout",
+			args:    []string{"-c", "sleep 5 | cat"},
+			timeout: 50 * time.Millisecond,
+			errMsg:  "command [sh] timed out after 50ms",
+		},
+	}
 )
 
+// echoServer answers like the DNS based IP echo services do
+func echoServer(t *testing.T) (*dns.Server, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			q := req.Question[0]
+			switch {
+			case q.Name == "myip.opendns.com." && q.Qtype == dns.TypeA:
+				rr, _ := dns.NewRR("myip.opendns.com. 0 IN A 1.2.3.4")
+				res.Answer = append(res.Answer, rr)
+			case q.Name == "myip.opendns.com." && q.Qtype == dns.TypeAAAA:
+				rr, _ := dns.NewRR("myip.opendns.com. 0 IN AAAA 2001:db8::1")
+				res.Answer = append(res.Answer, rr)
+			case q.Name == "whoami.cloudflare." && q.Qclass == dns.ClassCHAOS:
+				rr, _ := dns.NewRR(`whoami.cloudflare. 0 CH TXT "5.6.7.8"`)
+				res.Answer = append(res.Answer, rr)
+			case q.Name != "myip.opendns.com.":
+				res.Rcode = dns.RcodeNameError
+			}
+			w.WriteMsg(res)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+
+	return server, pc.LocalAddr().String()
+}
+
+// stunServer answers binding requests with the address they came from, in the
+// given attribute, or with an error response when the attribute is zero
+func stunServer(t *testing.T, attrType uint16) (net.PacketConn, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			req := buffer[:n]
+			if n < stunHeaderLength || binary.BigEndian.Uint16(req[0:2]) != stunBindingRequest {
+				continue
+			}
+
+			res := make([]byte, stunHeaderLength, stunHeaderLength+12)
+			binary.BigEndian.PutUint16(res[0:2], stunBindingSuccess)
+			copy(res[4:20], req[4:20])
+			if attrType == 0 {
+				binary.BigEndian.PutUint16(res[0:2], stunBindingError)
+			} else {
+				udpAddr := addr.(*net.UDPAddr)
+				value := make([]byte, 8)
+				value[1] = stunFamilyIPv4
+				copy(value[4:8], udpAddr.IP.To4())
+				if attrType == stunXORMappedAddress {
+					for i := range value[4:8] {
+						value[4+i] ^= req[4+i]
+					}
+				}
+
+				// an unknown attribute with padding comes first
+				res = append(res, 0x80, 0x22, 0x00, 0x03, 'a', 'b', 'c', 0x00)
+				attr := make([]byte, 4)
+				binary.BigEndian.PutUint16(attr[0:2], attrType)
+				binary.BigEndian.PutUint16(attr[2:4], uint16(len(value)))
+				res = append(append(res, attr...), value...)
+			}
+			binary.BigEndian.PutUint16(res[2:4], uint16(len(res)-stunHeaderLength))
+			pc.WriteTo(res, addr)
+		}
+	}()
+
+	return pc, pc.LocalAddr().String()
+}
+
+// udpResponder answers every UDP request with the response returned by the
+// handler, unless that is nil
+func udpResponder(t *testing.T, handler func(req []byte) []byte) (net.PacketConn, int) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if res := handler(append([]byte{}, buffer[:n]...)); res != nil {
+				pc.WriteTo(res, addr)
+			}
+		}
+	}()
+
+	return pc, pc.LocalAddr().(*net.UDPAddr).Port
+}
+
+// natPMPResponder answers NAT-PMP external address requests with the given IP
+func natPMPResponder(ip string) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		res := make([]byte, 12)
+		res[1] = 128
+		copy(res[8:12], net.ParseIP(ip).To4())
+		return res
+	}
+}
+
+// pcpResponder only speaks PCP, and maps every port to the given IP
+func pcpResponder(ip string) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		if req[0] != pcpVersion {
+			return []byte{pcpVersion, 0x80, 0, 1}
+		}
+		res := make([]byte, 60)
+		res[0] = pcpVersion
+		res[1] = 0x80 | req[1]
+		copy(res[4:8], req[4:8])
+		copy(res[24:44], req[24:44])
+		copy(res[44:60], net.ParseIP(ip).To16())
+		return res
+	}
+}
+
+// upnpGateway serves the device description and control URL of a gateway
+func upnpGateway(ip string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>`+
+			`<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><deviceList><device>`+
+			`<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><deviceList><device>`+
+			`<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>`+
+			`<controlURL>/ctl/IPConn</controlURL></service></serviceList>`+
+			`</device></deviceList></device></deviceList></device></root>`)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("SOAPAction") != `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"` {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+			`<NewExternalIPAddress>`+ip+`</NewExternalIPAddress>`+
+			`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+	})
+	return httptest.NewServer(mux)
+}
+
+func mustRequest(t *testing.T, resolver *Resolver) *http.Request {
+	req, err := resolver.newRequest()
+	assert.Nil(t, err)
+	return req
+}
+
 // RoundTripFunc is the signature for fake transport func
 type RoundTripFunc func(req *http.Request) *http.Response
 
@@ -248,6 +928,13 @@ func TestResolver(t *testing.T) {
 		resolver := Resolver{}
 		resolver.Init()
 		assert.NotNil(t, resolver.HTTPClient)
+		assert.Equal(t, 10*time.Second, resolver.HTTPClient.Timeout)
+		assert.False(t, resolver.IsIPv6())
+
+		resolver6 := Resolver{Network: "tcp6"}
+		resolver6.Init()
+		assert.NotNil(t, resolver6.HTTPClient)
+		assert.True(t, resolver6.IsIPv6())
 	})
 
 	t.Run("readIPText", func(t *testing.T) {
@@ -268,6 +955,22 @@ func TestResolver(t *testing.T) {
 
 	})
 
+	t.Run("checkFamily", func(t *testing.T) {
+		for _, tc := range checkFamilyTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resolver := Resolver{Network: tc.network}
+				res, err := resolver.checkFamily(tc.ip)
+				if tc.errIsNil {
+					assert.Nil(t, err)
+					assert.Equal(t, tc.ip, res)
+				} else {
+					assert.Nil(t, res)
+					assert.Equal(t, tc.errMsg, err.Error())
+				}
+			})
+		}
+	})
+
 	t.Run("readIPJSON", func(t *testing.T) {
 
 		resolver := Resolver{
@@ -290,6 +993,38 @@ func TestResolver(t *testing.T) {
 		}
 	})
 
+	t.Run("readIPRegex", func(t *testing.T) {
+		for _, tc := range readIPRegexTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resolver := Resolver{Type: "regex", Pattern: tc.pattern}
+				result, err := resolver.readIPRegex(*mockHTTPResponse(tc.response))
+				assert.Equal(t, tc.result, result)
+				if len(tc.errMsg) > 0 {
+					assert.NotNil(t, err)
+					assert.Equal(t, tc.errMsg, err.Error())
+				} else {
+					assert.Nil(t, err)
+				}
+			})
+		}
+	})
+
+	t.Run("readIPMarkup", func(t *testing.T) {
+		for _, tc := range readIPMarkupTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resolver := Resolver{Type: tc.resolverType, XPath: tc.xpath}
+				result, err := resolver.readIPMarkup(*mockHTTPResponse(tc.response))
+				assert.Equal(t, tc.result, result)
+				if len(tc.errMsg) > 0 {
+					assert.NotNil(t, err)
+					assert.Equal(t, tc.errMsg, err.Error())
+				} else {
+					assert.Nil(t, err)
+				}
+			})
+		}
+	})
+
 	t.Run("GetExternalIP", func(t *testing.T) {
 
 		for _, tc := range getExternalIPTestCases {
@@ -321,4 +1056,551 @@ func TestResolver(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("httpOptions", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			username, password, _ := req.BasicAuth()
+			switch req.URL.Path {
+			case "/slow":
+				time.Sleep(200 * time.Millisecond)
+			case "/large":
+				fmt.Fprint(w, strings.Repeat(" ", 64)+"1.2.3.4")
+				return
+			}
+			fmt.Fprintf(w, `{"ip": "1.2.3.4", "method": "%s", "body": "%s", "key": "%s", "agent": "%s", "auth": "%s", "user": "%s:%s"}`,
+				req.Method, body, req.Header.Get("X-Api-Key"), req.UserAgent(), req.Header.Get("Authorization"), username, password)
+		}))
+		defer server.Close()
+
+		query := func(resolver Resolver, jsonPath string) (string, error) {
+			resolver.Name, resolver.Type, resolver.JSONPath = "test", "json", jsonPath
+			if len(resolver.URL) == 0 {
+				resolver.URL = server.URL
+			}
+			resolver.Init()
+			res, err := resolver.HTTPClient.Do(mustRequest(t, &resolver))
+			if err != nil {
+				return "", err
+			}
+			res.Body = resolver.limitBody(res.Body)
+			doc, err := resolver.getResponseJSON(*res)
+			if err != nil {
+				return "", err
+			}
+			return resolver.findIPString(doc)
+		}
+
+		// defaults
+		value, err := query(Resolver{}, "method")
+		assert.Nil(t, err)
+		assert.Equal(t, "GET", value)
+		value, _ = query(Resolver{}, "agent")
+		assert.Equal(t, "cloudflare-ddns", value)
+		value, _ = query(Resolver{}, "auth")
+		assert.Equal(t, "", value)
+
+		// method, body, headers and user agent
+		resolver := Resolver{
+			Method:    "post",
+			Body:      "format=json",
+			Headers:   map[string]string{"x-api-key": "secret"},
+			UserAgent: "home-router/1.0",
+		}
+		value, _ = query(resolver, "method")
+		assert.Equal(t, "POST", value)
+		value, _ = query(resolver, "body")
+		assert.Equal(t, "format=json", value)
+		value, _ = query(resolver, "key")
+		assert.Equal(t, "secret", value)
+		value, _ = query(resolver, "agent")
+		assert.Equal(t, "home-router/1.0", value)
+
+		// credentials
+		value, _ = query(Resolver{Username: "user", Password: "pass"}, "user")
+		assert.Equal(t, "user:pass", value)
+		value, _ = query(Resolver{Token: "token"}, "auth")
+		assert.Equal(t, "Bearer token", value)
+
+		// whole query timeout
+		_, err = query(Resolver{URL: server.URL + "/slow", Timeout: 50 * time.Millisecond}, "ip")
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "Client.Timeout exceeded")
+
+		// response size
+		resolver = Resolver{Name: "test", Type: "text", URL: server.URL + "/large", MaxResponseSize: 64}
+		resolver.Init()
+		res, err := resolver.GetExternalIP()
+		assert.Nil(t, res)
+		assert.NotNil(t, err)
+		assert.Equal(t, "response is larger than [64] bytes", err.Error())
+		resolver.MaxResponseSize = 71
+		res, err = resolver.GetExternalIP()
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("1.2.3.4"), res)
+
+		resolver.Method = "GET /"
+		_, err = resolver.GetExternalIP()
+		assert.NotNil(t, err)
+		assert.Equal(t, `net/http: invalid method "GET /"`, err.Error())
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, "1.2.3.4")
+		}))
+		defer server.Close()
+
+		bundle := filepath.Join(t.TempDir(), "ca.pem")
+		err := ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+		assert.Nil(t, err)
+		digest := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+		pin := "sha256/" + base64.StdEncoding.EncodeToString(digest[:])
+		otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+		query := func(resolver Resolver) (net.IP, error) {
+			resolver.Name, resolver.Type, resolver.URL = "test", "text", server.URL
+			err := resolver.Init()
+			if err != nil {
+				return nil, err
+			}
+			return resolver.GetExternalIP()
+		}
+
+		// verified by default
+		_, err = query(Resolver{})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "certificate signed by unknown authority")
+
+		res, err := query(Resolver{CABundle: bundle})
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("1.2.3.4"), res)
+
+		res, err = query(Resolver{CABundle: bundle, Pins: []string{otherPin, pin}})
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("1.2.3.4"), res)
+
+		_, err = query(Resolver{CABundle: bundle, Pins: []string{otherPin}})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "certificate of resolver [test] does not match any of its pins")
+
+		// pins still apply without verification
+		res, err = query(Resolver{NoVerify: true})
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("1.2.3.4"), res)
+		_, err = query(Resolver{NoVerify: true, Pins: []string{otherPin}})
+		assert.NotNil(t, err)
+
+		_, err = query(Resolver{Pins: []string{"sha256/abc"}})
+		assert.NotNil(t, err)
+		assert.Equal(t, "invalid pin for resolver [test]: [sha256/abc] is not a base64 encoded SHA-256 digest", err.Error())
+
+		_, err = query(Resolver{CABundle: filepath.Join(t.TempDir(), "missing.pem")})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "cannot load the CA bundle of resolver [test]")
+
+		_, err = query(Resolver{MinTLSVersion: "1.4"})
+		assert.NotNil(t, err)
+		assert.Equal(t, "unsupported minimum TLS version for resolver [test]: [1.4]", err.Error())
+
+		resolver := Resolver{Name: "test"}
+		assert.Nil(t, resolver.Init())
+		tlsConfig := resolver.HTTPClient.Transport.(*http.Transport).TLSClientConfig
+		assert.False(t, tlsConfig.InsecureSkipVerify)
+		assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			host, _, _ := net.SplitHostPort(req.RemoteAddr)
+			fmt.Fprint(w, host)
+		}))
+		defer server.Close()
+
+		resolver := Resolver{Name: "test", Type: "text", URL: server.URL, BindAddress: "127.0.0.2"}
+		assert.Nil(t, resolver.Init())
+		res, err := resolver.GetExternalIP()
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("127.0.0.2"), res)
+
+		// the DNS client is bound as well
+		dnsServer, addr := echoServer(t)
+		defer dnsServer.Shutdown()
+		resolver = Resolver{Name: "test", Type: "dns", Server: addr, Query: "myip.opendns.com", BindAddress: "127.0.0.2"}
+		assert.Nil(t, resolver.Init())
+		assert.Equal(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.2")}, resolver.DNSClient.Dialer.LocalAddr)
+		_, err = resolver.GetExternalIP()
+		assert.Nil(t, err)
+
+		// so is asking the gateway
+		defer func(port int) { natPMPPort = port }(natPMPPort)
+		gateway, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer gateway.Close()
+		natPMPPort = gateway.LocalAddr().(*net.UDPAddr).Port
+		go func() {
+			buffer := make([]byte, 1500)
+			n, addr, err := gateway.ReadFrom(buffer)
+			if err == nil && addr.(*net.UDPAddr).IP.Equal(net.ParseIP("127.0.0.2")) {
+				gateway.WriteTo(natPMPResponder("1.2.3.4")(buffer[:n]), addr)
+			}
+		}()
+		resolver = Resolver{Name: "test", Type: "gateway", Server: "127.0.0.1", BindAddress: "127.0.0.2"}
+		assert.Nil(t, resolver.Init())
+		res, err = resolver.GetExternalIP()
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("1.2.3.4"), res)
+		conn, err := resolver.listenPacket("udp4")
+		assert.Nil(t, err)
+		assert.Equal(t, "127.0.0.2", conn.LocalAddr().(*net.UDPAddr).IP.String())
+		conn.Close()
+
+		resolver = Resolver{Name: "test", BindAddress: "wan1"}
+		err = resolver.Init()
+		assert.NotNil(t, err)
+		assert.Equal(t, "invalid bind address for resolver [test]: [wan1]", err.Error())
+
+		if runtime.GOOS == "linux" && os.Geteuid() == 0 {
+			resolver = Resolver{Name: "test", Type: "text", URL: server.URL, BindInterface: "lo"}
+			assert.Nil(t, resolver.Init())
+			res, err = resolver.GetExternalIP()
+			assert.Nil(t, err)
+			assert.Equal(t, net.ParseIP("127.0.0.1"), res)
+		}
+	})
+
+	t.Run("GetUplinks", func(t *testing.T) {
+		defer viper.Set("uplinks", nil)
+
+		viper.Set("uplinks", []map[string]interface{}{
+			{"name": "wan1", "resolvers": []map[string]interface{}{{"name": "wan1-ipify", "type": "text", "url": "https://api.ipify.org", "bindInterface": "eth1"}}},
+			{"name": "wan2", "resolvers": []map[string]interface{}{{"name": "wan2-ipify", "type": "text", "url": "https://api.ipify.org", "bindAddress": "192.0.2.10", "timeout": "5s"}}},
+		})
+		uplinks, err := GetUplinks()
+		if runtime.GOOS != "linux" {
+			assert.NotNil(t, err)
+			return
+		}
+		assert.Nil(t, err)
+		assert.Len(t, uplinks, 2)
+		assert.Equal(t, "wan1", uplinks[0].Name)
+		assert.Equal(t, "eth1", uplinks[0].Resolvers[0].BindInterface)
+		assert.NotNil(t, uplinks[0].Resolvers[0].HTTPClient)
+		assert.Equal(t, "192.0.2.10", uplinks[1].Resolvers[0].BindAddress)
+		assert.Equal(t, 5*time.Second, uplinks[1].Resolvers[0].Timeout)
+
+		viper.Set("uplinks", []map[string]interface{}{{"name": "wan1", "resolvers": []map[string]interface{}{}}})
+		_, err = GetUplinks()
+		assert.NotNil(t, err)
+		assert.Equal(t, "uplink [wan1] has no resolvers", err.Error())
+
+		viper.Set("uplinks", []map[string]interface{}{{"resolvers": []map[string]interface{}{{"name": "ipify"}}}})
+		_, err = GetUplinks()
+		assert.NotNil(t, err)
+		assert.Equal(t, "uplink entry without a name", err.Error())
+
+		viper.Set("uplinks", []map[string]interface{}{
+			{"name": "wan1", "resolvers": []map[string]interface{}{{"name": "first"}}},
+			{"name": "wan1", "resolvers": []map[string]interface{}{{"name": "second"}}},
+		})
+		_, err = GetUplinks()
+		assert.NotNil(t, err)
+		assert.Equal(t, "duplicate uplink: [wan1]", err.Error())
+	})
+
+	t.Run("Consensus", func(t *testing.T) {
+		newResolver := func(name string, statusCode int, body string) Resolver {
+			return Resolver{
+				Name: name,
+				Type: "text",
+				HTTPClient: NewTestClient(func(req *http.Request) *http.Response {
+					return &http.Response{
+						StatusCode: statusCode,
+						Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+						Header:     make(http.Header),
+					}
+				}),
+			}
+		}
+		resolvers := []Resolver{
+			newResolver("first", 200, "1.2.3.4"),
+			newResolver("second", 200, "5.6.7.8"),
+			newResolver("third", 200, "1.2.3.4"),
+			newResolver("fourth", 500, ""),
+		}
+		query := func(rslv Resolver) (net.IP, error) {
+			return rslv.GetExternalIP()
+		}
+
+		ip, dissent, err := Consensus(resolvers, 2, query)
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("1.2.3.4"), ip)
+		assert.Len(t, dissent, 2)
+		assert.Equal(t, "second: 5.6.7.8", dissent[0].String())
+		assert.Equal(t, "fourth: provider responded with HTTP/500", dissent[1].String())
+
+		ip, dissent, err = Consensus(resolvers, 3, query)
+		assert.Equal(t, ErrNoQuorum, err)
+		assert.Nil(t, ip)
+		assert.Len(t, dissent, 4)
+
+		ip, _, err = Consensus(resolvers[3:], 1, query)
+		assert.Equal(t, ErrNoQuorum, err)
+		assert.Nil(t, ip)
+	})
+
+	t.Run("GetExternalIPDNS", func(t *testing.T) {
+		server, addr := echoServer(t)
+		defer server.Shutdown()
+
+		for _, tc := range getExternalIPDNSTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resolver := Resolver{
+					Name:       "test",
+					Type:       "dns",
+					Server:     addr,
+					Query:      tc.query,
+					QueryType:  tc.queryType,
+					QueryClass: tc.queryClass,
+					Network:    tc.network,
+					DNSClient:  &dns.Client{},
+				}
+
+				res, err := resolver.GetExternalIP()
+				if tc.errIsNil {
+					assert.Nil(t, err)
+					assert.Equal(t, tc.result, res)
+				} else {
+					assert.NotNil(t, err)
+					assert.Equal(t, tc.errMsg, err.Error())
+					assert.Nil(t, res)
+				}
+			})
+		}
+
+		resolver := Resolver{Name: "test", Type: "dns", Server: addr, Timeout: time.Second}
+		assert.Nil(t, resolver.initDNS())
+		assert.Equal(t, time.Second, resolver.DNSClient.Timeout)
+	})
+
+	t.Run("GetExternalIPSTUN", func(t *testing.T) {
+		for _, attrType := range []uint16{stunXORMappedAddress, stunMappedAddress} {
+			pc, addr := stunServer(t, attrType)
+			resolver := Resolver{Name: "test", Type: "stun", Server: addr}
+			res, err := resolver.GetExternalIP()
+			assert.Nil(t, err)
+			assert.Equal(t, net.ParseIP("127.0.0.1"), res)
+			assert.False(t, resolver.IsRateLimited())
+			pc.Close()
+		}
+
+		pc, addr := stunServer(t, 0)
+		defer pc.Close()
+		resolver := Resolver{Name: "test", Type: "stun", Server: addr}
+		res, err := resolver.GetExternalIP()
+		assert.Nil(t, res)
+		assert.NotNil(t, err)
+		assert.Equal(t, "STUN server responded with an error", err.Error())
+
+		// a server that never answers is given up on after the timeout
+		silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer silent.Close()
+		resolver = Resolver{Name: "test", Type: "stun", Server: silent.LocalAddr().String(), Timeout: 50 * time.Millisecond}
+		started := time.Now()
+		_, err = resolver.GetExternalIP()
+		assert.NotNil(t, err)
+		assert.True(t, time.Since(started) < time.Second)
+
+		resolver = Resolver{Name: "test", Type: "stun"}
+		_, err = resolver.GetExternalIP()
+		assert.NotNil(t, err)
+		assert.Equal(t, "STUN resolver [test] requires a server", err.Error())
+
+		_, err = parseBindingResponse(make([]byte, 10), nil)
+		assert.NotNil(t, err)
+		assert.Equal(t, "invalid STUN response", err.Error())
+	})
+
+	t.Run("selectAddress", func(t *testing.T) {
+		for _, tc := range selectAddressTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resolver := Resolver{Type: "interface", Interface: "ppp0", Network: tc.network, Selection: tc.selection, Prefix: tc.prefix}
+				res, err := resolver.selectAddress(tc.addrs)
+				if len(tc.errMsg) == 0 {
+					assert.Nil(t, err)
+					assert.Equal(t, tc.result, res)
+				} else {
+					assert.NotNil(t, err)
+					assert.Equal(t, tc.errMsg, err.Error())
+					assert.Nil(t, res)
+				}
+			})
+		}
+	})
+
+	t.Run("Reserved", func(t *testing.T) {
+		for ip, kind := range map[string]string{
+			"10.0.0.1":       "private",
+			"fd00::1":        "private",
+			"100.64.1.2":     ReservedCGNAT,
+			"127.0.0.1":      "loopback",
+			"169.254.1.1":    "link-local",
+			"203.0.113.7":    "documentation",
+			"2001:db8::1":    "documentation",
+			"239.1.1.1":      "multicast",
+			"0.1.2.3":        "unspecified",
+			"1.2.3.4":        "",
+			"2a00:1:1::1":    "",
+			"::ffff:1.2.3.4": "",
+		} {
+			assert.Equal(t, kind, Reserved(net.ParseIP(ip)), ip)
+		}
+
+		original := interfaceAddrs
+		defer func() { interfaceAddrs = original }()
+		interfaceAddrs = func(name string) ([]ifaceAddr, error) {
+			return testInterfaceAddrs[:2], nil
+		}
+		addrs, err := InterfaceAddrs()
+		assert.Nil(t, err)
+		for _, ips := range addrs {
+			assert.Equal(t, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("192.168.1.1")}, ips)
+		}
+	})
+
+	t.Run("GetExternalIPInterface", func(t *testing.T) {
+		original := interfaceAddrs
+		defer func() { interfaceAddrs = original }()
+		interfaceAddrs = func(name string) ([]ifaceAddr, error) {
+			assert.Equal(t, "ppp0", name)
+			return testInterfaceAddrs, nil
+		}
+
+		resolver := Resolver{Name: "test", Type: "interface", Interface: "ppp0"}
+		res, err := resolver.GetExternalIP()
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("1.2.3.10"), res)
+		assert.False(t, resolver.IsRateLimited())
+
+		// the loopback interface never holds an external IP
+		interfaceAddrs = original
+		resolver.Interface = "lo"
+		_, err = resolver.GetExternalIP()
+		assert.NotNil(t, err)
+
+		resolver.Interface = ""
+		_, err = resolver.GetExternalIP()
+		assert.NotNil(t, err)
+		assert.Equal(t, "interface resolver [test] requires an interface", err.Error())
+	})
+
+	t.Run("parseRouteTable", func(t *testing.T) {
+		header := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+		lan := "eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n"
+		res, err := parseRouteTable(strings.NewReader(header+lan+"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n"), binary.LittleEndian)
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("192.168.1.1"), res)
+
+		// big-endian hosts, such as MIPS routers, write the addresses the other way round
+		res, err = parseRouteTable(strings.NewReader(header+"eth0\t00000000\tC0A80101\t0003\t0\t0\t100\t00000000\t0\t0\t0\n"), binary.BigEndian)
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("192.168.1.1"), res)
+
+		_, err = parseRouteTable(strings.NewReader(header+lan), binary.LittleEndian)
+		assert.NotNil(t, err)
+		assert.Equal(t, "no default gateway found, set the gateway as server", err.Error())
+	})
+
+	t.Run("GetExternalIPGateway", func(t *testing.T) {
+		defer func(port int, addr string, timeout time.Duration) {
+			natPMPPort, ssdpAddr, gatewayTimeout = port, addr, timeout
+		}(natPMPPort, ssdpAddr, gatewayTimeout)
+		gatewayTimeout = 10 * time.Millisecond
+
+		resolver := Resolver{Name: "test", Type: "gateway", Server: "127.0.0.1"}
+		assert.False(t, resolver.IsRateLimited())
+
+		// NAT-PMP
+		pc, port := udpResponder(t, natPMPResponder("1.2.3.7"))
+		natPMPPort = port
+		res, err := resolver.GetExternalIP()
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("1.2.3.7"), res)
+		pc.Close()
+
+		// PCP
+		pc, port = udpResponder(t, pcpResponder("5.6.7.9"))
+		natPMPPort = port
+		res, err = resolver.GetExternalIP()
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("5.6.7.9"), res)
+		pc.Close()
+
+		// double NAT
+		pc, port = udpResponder(t, natPMPResponder("100.64.0.5"))
+		natPMPPort = port
+		res, err = resolver.GetExternalIP()
+		assert.Nil(t, res)
+		assert.NotNil(t, err)
+		assert.Equal(t, "gateway [127.0.0.1] reports [100.64.0.5] as its external address, it is behind another NAT", err.Error())
+		pc.Close()
+
+		// UPnP IGD, with NAT-PMP not answering
+		pc, port = udpResponder(t, func(req []byte) []byte { return nil })
+		natPMPPort = port
+		defer pc.Close()
+
+		server := upnpGateway("9.8.7.44")
+		defer server.Close()
+		ssdp, ssdpPort := udpResponder(t, func(req []byte) []byte {
+			if !strings.Contains(string(req), "ST: "+ssdpSearchTarget) {
+				return nil
+			}
+			return []byte("HTTP/1.1 200 OK\r\nST: " + ssdpSearchTarget + "\r\nLOCATION: " + server.URL + "/desc.xml\r\n\r\n")
+		})
+		defer ssdp.Close()
+		ssdpAddr = "127.0.0.1:" + strconv.Itoa(ssdpPort)
+
+		res, err = resolver.GetExternalIP()
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("9.8.7.44"), res)
+
+		resolver.Server = "gateway"
+		_, err = resolver.GetExternalIP()
+		assert.NotNil(t, err)
+		assert.Equal(t, "invalid gateway address: [gateway]", err.Error())
+	})
+
+	t.Run("GetExternalIPExec", func(t *testing.T) {
+		for _, tc := range getExternalIPExecTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resolver := Resolver{
+					Name:    "test",
+					Type:    "exec",
+					Network: tc.network,
+					Command: "sh",
+					Args:    tc.args,
+					Env:     tc.env,
+					Timeout: tc.timeout,
+				}
+				started := time.Now()
+				res, err := resolver.GetExternalIP()
+				assert.Less(t, int64(time.Since(started)), int64(2*time.Second))
+				if len(tc.errMsg) > 0 {
+					assert.Nil(t, res)
+					assert.NotNil(t, err)
+					assert.Equal(t, tc.errMsg, err.Error())
+				} else {
+					assert.Nil(t, err)
+					assert.Equal(t, tc.result, res)
+				}
+			})
+		}
+
+		resolver := Resolver{Name: "test", Type: "exec"}
+		_, err := resolver.GetExternalIP()
+		assert.NotNil(t, err)
+		assert.Equal(t, "exec resolver [test] requires a command", err.Error())
+	})
 }
@@ -0,0 +1,181 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kerti/cloudflare-ddns/logger"
+)
+
+const (
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunBindingError     = 0x0111
+	stunMagicCookie      = 0x2112A442
+	stunHeaderLength     = 20
+	stunMappedAddress    = 0x0001
+	stunXORMappedAddress = 0x0020
+	stunFamilyIPv4       = 0x01
+	stunFamilyIPv6       = 0x02
+
+	// stunTimeout bounds the whole round trip of a binding request, unless the
+	// resolver sets a timeout of its own
+	stunTimeout = 5 * time.Second
+)
+
+// newBindingRequest returns an RFC 5389 binding request without attributes
+func newBindingRequest(transactionID []byte) []byte {
+	req := make([]byte, stunHeaderLength)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(req[2:4], 0)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	copy(req[8:20], transactionID)
+	return req
+}
+
+// getExternalIPSTUN sends a binding request to the STUN server, and reads the
+// external IP from the mapped address of the response
+func (r *Resolver) getExternalIPSTUN() (net.IP, error) {
+	if len(r.Server) == 0 {
+		err := fmt.Errorf("STUN resolver [%s] requires a server", r.Name)
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	server := r.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "3478")
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = stunTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	err := r.bindDialer(dialer, r.udpNetwork())
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	conn, err := dialer.Dial(r.udpNetwork(), server)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	transactionID := make([]byte, 12)
+	rand.Read(transactionID)
+	_, err = conn.Write(newBindingRequest(transactionID))
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	buffer := make([]byte, 1500)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	ip, err := parseBindingResponse(buffer[:n], transactionID)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	logger.Debug("[RESOLVER] [%s] Detected external IP: %v", r.Server, ip)
+	return ip, nil
+}
+
+// parseBindingResponse reads the mapped address of a binding response,
+// preferring the XOR-MAPPED-ADDRESS over the MAPPED-ADDRESS of older servers
+func parseBindingResponse(res []byte, transactionID []byte) (net.IP, error) {
+	if len(res) < stunHeaderLength || binary.BigEndian.Uint32(res[4:8]) != stunMagicCookie {
+		return nil, fmt.Errorf("invalid STUN response")
+	}
+	if !bytes.Equal(res[8:20], transactionID) {
+		return nil, fmt.Errorf("STUN response does not match the request")
+	}
+
+	switch binary.BigEndian.Uint16(res[0:2]) {
+	case stunBindingSuccess:
+	case stunBindingError:
+		return nil, fmt.Errorf("STUN server responded with an error")
+	default:
+		return nil, fmt.Errorf("unexpected STUN response type: [0x%04x]", binary.BigEndian.Uint16(res[0:2]))
+	}
+
+	length := int(binary.BigEndian.Uint16(res[2:4]))
+	if stunHeaderLength+length > len(res) {
+		return nil, fmt.Errorf("truncated STUN response")
+	}
+
+	var mapped net.IP
+	attributes := res[stunHeaderLength : stunHeaderLength+length]
+	for len(attributes) >= 4 {
+		attrType := binary.BigEndian.Uint16(attributes[0:2])
+		attrLength := int(binary.BigEndian.Uint16(attributes[2:4]))
+		if 4+attrLength > len(attributes) {
+			return nil, fmt.Errorf("truncated STUN response")
+		}
+		value := attributes[4 : 4+attrLength]
+
+		switch attrType {
+		case stunXORMappedAddress:
+			return parseAddress(value, res[4:20])
+		case stunMappedAddress:
+			mapped, _ = parseAddress(value, nil)
+		}
+
+		// attributes are padded to a multiple of 4 bytes
+		padded := (attrLength + 3) &^ 3
+		if 4+padded > len(attributes) {
+			break
+		}
+		attributes = attributes[4+padded:]
+	}
+
+	if mapped == nil {
+		return nil, fmt.Errorf("no mapped address in STUN response")
+	}
+	return mapped, nil
+}
+
+// parseAddress reads the IP of an address attribute, XORed with the given key
+// made of the magic cookie and the transaction ID, if any
+func parseAddress(value []byte, key []byte) (net.IP, error) {
+	if len(value) < 4 {
+		return nil, fmt.Errorf("invalid STUN address")
+	}
+
+	var size int
+	switch value[1] {
+	case stunFamilyIPv4:
+		size = net.IPv4len
+	case stunFamilyIPv6:
+		size = net.IPv6len
+	default:
+		return nil, fmt.Errorf("unsupported STUN address family: [%d]", value[1])
+	}
+	if len(value) < 4+size {
+		return nil, fmt.Errorf("invalid STUN address")
+	}
+
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if key != nil {
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+
+	return ip.To16(), nil
+}
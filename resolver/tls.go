@@ -0,0 +1,94 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/kerti/cloudflare-ddns/config"
+	"github.com/kerti/cloudflare-ddns/logger"
+)
+
+// tlsVersions maps the configurable minimum TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultMinTLSVersion is the oldest TLS version spoken unless configured
+const defaultMinTLSVersion = "1.2"
+
+// tlsConfig builds the TLS configuration of the resolver. Certificates are
+// verified against the system roots, or the configured CA bundle, and must
+// match one of the pins if any are configured.
+func (r *Resolver) tlsConfig() (*tls.Config, error) {
+	minVersion := r.MinTLSVersion
+	if len(minVersion) == 0 {
+		minVersion = defaultMinTLSVersion
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported minimum TLS version for resolver [%s]: [%s]", r.Name, r.MinTLSVersion)
+	}
+
+	cfg := &tls.Config{MinVersion: version}
+
+	if len(r.CABundle) > 0 {
+		pool, err := config.CertPool(r.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load the CA bundle of resolver [%s]: %s", r.Name, err.Error())
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(r.Pins) > 0 {
+		pins, err := parsePins(r.Pins)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin for resolver [%s]: %s", r.Name, err.Error())
+		}
+		name := r.Name
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(name, state, pins)
+		}
+	}
+
+	if r.NoVerify {
+		logger.Warn("[RESOLVER] TLS certificate verification is DISABLED for [%s], anyone on the path can forge its answers and redirect your DNS records!", r.Name)
+		cfg.InsecureSkipVerify = true
+	}
+
+	return cfg, nil
+}
+
+// parsePins decodes SPKI pins, the base64 encoded SHA-256 digest of a public
+// key, optionally prefixed with `sha256/` as HPKP and curl write them
+func parsePins(pins []string) ([][]byte, error) {
+	result := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("[%s] is not a base64 encoded SHA-256 digest", pin)
+		}
+		result = append(result, digest)
+	}
+	return result, nil
+}
+
+// verifyPins checks that the public key of a certificate the server presented
+// matches one of the pins
+func verifyPins(name string, state tls.ConnectionState, pins [][]byte) error {
+	for _, cert := range state.PeerCertificates {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(digest[:], pin) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("certificate of resolver [%s] does not match any of its pins", name)
+}
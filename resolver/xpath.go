@@ -0,0 +1,357 @@
+package resolver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// markupNode is an element or a text node of an XML or HTML document
+type markupNode struct {
+	Name     string
+	Text     string
+	IsText   bool
+	Attrs    map[string]string
+	Children []*markupNode
+	Parent   *markupNode
+}
+
+func (n *markupNode) append(child *markupNode) {
+	child.Parent = n
+	n.Children = append(n.Children, child)
+}
+
+// innerText returns the text of the node and all its descendants
+func (n *markupNode) innerText() string {
+	if n.IsText {
+		return n.Text
+	}
+	var b strings.Builder
+	for _, child := range n.Children {
+		b.WriteString(child.innerText())
+	}
+	return b.String()
+}
+
+// parseXML reads an XML document into a tree, ignoring namespaces
+func parseXML(r io.Reader) (*markupNode, error) {
+	root := &markupNode{}
+	current := root
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &markupNode{Name: t.Name.Local, Attrs: make(map[string]string)}
+			for _, attr := range t.Attr {
+				node.Attrs[attr.Name.Local] = attr.Value
+			}
+			current.append(node)
+			current = node
+		case xml.EndElement:
+			current = current.Parent
+		case xml.CharData:
+			current.append(&markupNode{Text: string(t), IsText: true})
+		}
+	}
+
+	if len(root.Children) == 0 {
+		return nil, fmt.Errorf("empty XML document")
+	}
+	return root, nil
+}
+
+// parseHTML reads an HTML document into a tree, the way browsers do
+func parseHTML(r io.Reader) (*markupNode, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var convert func(source *html.Node, target *markupNode)
+	convert = func(source *html.Node, target *markupNode) {
+		for child := source.FirstChild; child != nil; child = child.NextSibling {
+			switch child.Type {
+			case html.ElementNode:
+				node := &markupNode{Name: child.Data, Attrs: make(map[string]string)}
+				for _, attr := range child.Attr {
+					node.Attrs[attr.Key] = attr.Val
+				}
+				target.append(node)
+				convert(child, node)
+			case html.TextNode:
+				target.append(&markupNode{Text: child.Data, IsText: true})
+			}
+		}
+	}
+
+	root := &markupNode{}
+	convert(doc, root)
+	return root, nil
+}
+
+// xpathStep is a single location step, along with its predicates
+type xpathStep struct {
+	descendant bool
+	test       string
+	predicates []func(node *markupNode, position int, size int) bool
+}
+
+// parseXPath parses the supported subset of XPath: absolute and relative
+// location paths over the child (`/`) and descendant (`//`) axes, `*`, `.`,
+// `..`, `text()` and `@attribute` steps, and positional (`[1]`, `[last()]`),
+// comparison (`[@id='ip']`, `[span='IPv4']`), `contains()` and
+// `starts-with()` predicates. Namespace prefixes are ignored.
+func parseXPath(expr string) ([]xpathStep, error) {
+	steps := make([]xpathStep, 0)
+	rest := strings.TrimSpace(expr)
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("invalid XPath [%s]: empty path", expr)
+	}
+
+	for len(rest) > 0 {
+		step := xpathStep{}
+		switch {
+		case strings.HasPrefix(rest, "//"):
+			step.descendant = true
+			rest = rest[2:]
+		case strings.HasPrefix(rest, "/"):
+			rest = rest[1:]
+		}
+
+		end := 0
+		for end < len(rest) && rest[end] != '/' {
+			if rest[end] == '[' {
+				closing := closingBracket(rest[end:])
+				if closing < 0 {
+					return nil, fmt.Errorf("invalid XPath [%s]: unclosed bracket", expr)
+				}
+				end += closing
+			}
+			end++
+		}
+		text := rest[:end]
+		rest = rest[end:]
+
+		test := text
+		if i := strings.Index(text, "["); i >= 0 {
+			test = text[:i]
+			for predicates := text[i:]; len(predicates) > 0; {
+				closing := closingBracket(predicates)
+				predicate, err := parsePredicate(strings.TrimSpace(predicates[1:closing]))
+				if err != nil {
+					return nil, fmt.Errorf("invalid XPath [%s]: %s", expr, err.Error())
+				}
+				step.predicates = append(step.predicates, predicate)
+				predicates = strings.TrimSpace(predicates[closing+1:])
+				if len(predicates) > 0 && predicates[0] != '[' {
+					return nil, fmt.Errorf("invalid XPath [%s]: unexpected [%s]", expr, predicates)
+				}
+			}
+		}
+
+		step.test = strings.TrimSpace(test)
+		if len(step.test) == 0 {
+			return nil, fmt.Errorf("invalid XPath [%s]: empty step", expr)
+		}
+		if i := strings.LastIndex(step.test, ":"); i >= 0 {
+			if strings.HasPrefix(step.test, "@") {
+				step.test = "@" + step.test[i+1:]
+			} else {
+				step.test = step.test[i+1:]
+			}
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// parsePredicate compiles a predicate into a function telling whether a node
+// at the given position among the candidates matches
+func parsePredicate(expr string) (func(node *markupNode, position int, size int) bool, error) {
+	if index, err := strconv.Atoi(expr); err == nil {
+		return func(node *markupNode, position int, size int) bool {
+			return position == index
+		}, nil
+	}
+	if expr == "last()" {
+		return func(node *markupNode, position int, size int) bool {
+			return position == size
+		}, nil
+	}
+
+	for _, function := range []string{"contains", "starts-with"} {
+		if !strings.HasPrefix(expr, function+"(") || !strings.HasSuffix(expr, ")") {
+			continue
+		}
+		args := strings.SplitN(expr[len(function)+1:len(expr)-1], ",", 2)
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s() takes two arguments", function)
+		}
+		operand := strings.TrimSpace(args[0])
+		literal, ok := unquote(strings.TrimSpace(args[1]))
+		if !ok {
+			return nil, fmt.Errorf("%s() takes a string literal", function)
+		}
+		match := strings.Contains
+		if function == "starts-with" {
+			match = strings.HasPrefix
+		}
+		return func(node *markupNode, position int, size int) bool {
+			value, ok := operandValue(node, operand)
+			return ok && match(value, literal)
+		}, nil
+	}
+
+	for _, op := range []string{"!=", "="} {
+		i := indexUnquoted(expr, op)
+		if i < 0 {
+			continue
+		}
+		operand := strings.TrimSpace(expr[:i])
+		literal, _ := unquote(strings.TrimSpace(expr[i+len(op):]))
+		equal := op == "="
+		return func(node *markupNode, position int, size int) bool {
+			value, ok := operandValue(node, operand)
+			return ok && (strings.TrimSpace(value) == literal) == equal
+		}, nil
+	}
+
+	if strings.ContainsAny(expr, "()'\" ") && expr != "text()" {
+		return nil, fmt.Errorf("unsupported predicate [%s]", expr)
+	}
+	return func(node *markupNode, position int, size int) bool {
+		_, ok := operandValue(node, expr)
+		return ok
+	}, nil
+}
+
+// indexUnquoted returns the index of the first occurrence of sep outside of
+// quoted strings
+func indexUnquoted(text string, sep string) int {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch {
+		case quote != 0:
+			if text[i] == quote {
+				quote = 0
+			}
+		case text[i] == '\'' || text[i] == '"':
+			quote = text[i]
+		case strings.HasPrefix(text[i:], sep):
+			return i
+		}
+	}
+	return -1
+}
+
+// operandValue returns the value of an attribute, of the node itself, or of
+// its first child element with the given name
+func operandValue(node *markupNode, operand string) (string, bool) {
+	switch {
+	case strings.HasPrefix(operand, "@"):
+		value, ok := node.Attrs[operand[1:]]
+		return value, ok
+	case operand == "." || operand == "text()":
+		return node.innerText(), true
+	}
+
+	for _, child := range node.Children {
+		if !child.IsText && child.Name == operand {
+			return child.innerText(), true
+		}
+	}
+	return "", false
+}
+
+// apply returns the nodes the step selects from the context node
+func (s xpathStep) apply(node *markupNode) []*markupNode {
+	candidates := make([]*markupNode, 0)
+	switch s.test {
+	case ".":
+		candidates = append(candidates, node)
+	case "..":
+		if node.Parent != nil {
+			candidates = append(candidates, node.Parent)
+		}
+	case "text()":
+		for _, child := range node.Children {
+			if child.IsText && len(strings.TrimSpace(child.Text)) > 0 {
+				candidates = append(candidates, child)
+			}
+		}
+	default:
+		if strings.HasPrefix(s.test, "@") {
+			if value, ok := node.Attrs[s.test[1:]]; ok {
+				candidates = append(candidates, &markupNode{Text: value, IsText: true, Parent: node})
+			}
+			break
+		}
+		for _, child := range node.Children {
+			if !child.IsText && (s.test == "*" || child.Name == s.test) {
+				candidates = append(candidates, child)
+			}
+		}
+	}
+
+	for _, predicate := range s.predicates {
+		matching := make([]*markupNode, 0)
+		for i, candidate := range candidates {
+			if predicate(candidate, i+1, len(candidates)) {
+				matching = append(matching, candidate)
+			}
+		}
+		candidates = matching
+	}
+	return candidates
+}
+
+// descendantsOrSelf returns the element and all elements nested in it
+func (n *markupNode) descendantsOrSelf() []*markupNode {
+	result := []*markupNode{n}
+	for _, child := range n.Children {
+		if !child.IsText {
+			result = append(result, child.descendantsOrSelf()...)
+		}
+	}
+	return result
+}
+
+// evalXPath returns the text of all nodes the steps select in the document
+func evalXPath(root *markupNode, steps []xpathStep) []string {
+	nodes := []*markupNode{root}
+	for _, step := range steps {
+		next := make([]*markupNode, 0)
+		for _, node := range nodes {
+			if node.IsText {
+				continue
+			}
+			if step.descendant {
+				for _, descendant := range node.descendantsOrSelf() {
+					next = append(next, step.apply(descendant)...)
+				}
+			} else {
+				next = append(next, step.apply(node)...)
+			}
+		}
+		nodes = next
+	}
+
+	result := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		result = append(result, node.innerText())
+	}
+	return result
+}
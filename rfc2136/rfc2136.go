@@ -0,0 +1,291 @@
+package rfc2136
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kerti/cloudflare-ddns/host"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/provider"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// CheckConfig checks the RFC 2136 configuration
+func CheckConfig() error {
+	if len(viper.GetStringSlice("rfc2136.hostnames")) == 0 {
+		logger.Debug("[RFC2136] No hostnames configured, RFC 2136 not in use.")
+		return nil
+	}
+
+	server := viper.GetString("rfc2136.server")
+	if len(server) == 0 {
+		return fmt.Errorf("RFC 2136 is not properly set up, check your config file")
+	}
+
+	keyName := viper.GetString("rfc2136.tsig.name")
+	secret := viper.GetString("rfc2136.tsig.secret")
+	if (len(keyName) == 0) != (len(secret) == 0) {
+		return fmt.Errorf("RFC 2136 TSIG requires both a key name and a secret, check your config file")
+	}
+
+	logger.Debug("[RFC2136] RFC 2136 configuration OK.")
+	return nil
+}
+
+// RFC2136 is the client sending dynamic updates to an authoritative nameserver
+type RFC2136 struct {
+	server    string
+	zone      string
+	ttl       int
+	keyName   string
+	algorithm string
+	client    *dns.Client
+	zonesLock sync.Mutex
+	zones     map[string]string
+}
+
+// New instantiates a new RFC 2136 client for the given hosts
+func New(hosts []host.Host) (*RFC2136, error) {
+	server := viper.GetString("rfc2136.server")
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	r := &RFC2136{
+		server: server,
+		zone:   viper.GetString("rfc2136.zone"),
+		ttl:    viper.GetInt("rfc2136.ttl"),
+		client: new(dns.Client),
+		zones:  make(map[string]string),
+	}
+	if len(r.zone) > 0 {
+		r.zone = dns.Fqdn(r.zone)
+	}
+	if r.ttl <= 0 {
+		r.ttl = 300
+	}
+
+	keyName := viper.GetString("rfc2136.tsig.name")
+	if len(keyName) > 0 {
+		r.keyName = dns.Fqdn(keyName)
+		r.algorithm = dns.Fqdn(strings.ToLower(viper.GetString("rfc2136.tsig.algorithm")))
+		if r.algorithm == "." {
+			r.algorithm = dns.HmacSHA256
+		}
+		r.client.TsigSecret = map[string]string{r.keyName: viper.GetString("rfc2136.tsig.secret")}
+	}
+
+	for _, h := range hosts {
+		if len(h.ZoneID) > 0 {
+			r.zones[dns.Fqdn(h.Name)] = dns.Fqdn(h.ZoneID)
+		}
+	}
+
+	return r, nil
+}
+
+// Name returns the name of the provider
+func (r *RFC2136) Name() string {
+	return "rfc2136"
+}
+
+// zoneFor finds the zone a host belongs to, either from the host's explicit
+// override, from the configured zone, or from the SOA served for the host.
+// Lookups are serialized, so that the cache is safe to share between hosts.
+func (r *RFC2136) zoneFor(name string) (string, error) {
+	r.zonesLock.Lock()
+	defer r.zonesLock.Unlock()
+
+	fqdn := dns.Fqdn(name)
+	if zone, ok := r.zones[fqdn]; ok {
+		return zone, nil
+	}
+
+	if len(r.zone) > 0 && dns.IsSubDomain(r.zone, fqdn) {
+		r.zones[fqdn] = r.zone
+		return r.zone, nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSOA)
+	m.RecursionDesired = false
+	res, err := r.exchange(m)
+	if err != nil && (res == nil || res.Rcode != dns.RcodeNameError) {
+		return "", err
+	}
+
+	for _, rr := range append(res.Answer, res.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			logger.Debug("[RFC2136] Host [%s] belongs to zone [%s]", name, soa.Hdr.Name)
+			r.zones[fqdn] = soa.Hdr.Name
+			return soa.Hdr.Name, nil
+		}
+	}
+
+	err = fmt.Errorf("no zone found for host [%s]", name)
+	logger.Debug(err.Error())
+	return "", err
+}
+
+// exchange sends a message to the server, signing it if a TSIG key is configured
+func (r *RFC2136) exchange(m *dns.Msg) (*dns.Msg, error) {
+	if len(r.keyName) > 0 {
+		m.SetTsig(r.keyName, r.algorithm, 300, time.Now().Unix())
+	}
+
+	res, _, err := r.client.Exchange(m, r.server)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Rcode != dns.RcodeSuccess {
+		return res, fmt.Errorf("nameserver [%s] responded with %s", r.server, dns.RcodeToString[res.Rcode])
+	}
+
+	return res, nil
+}
+
+func newRR(name string, recordType string, ttl int, content string) (dns.RR, error) {
+	if recordType == "TXT" {
+		content = strconv.Quote(content)
+	}
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), ttl, recordType, content))
+}
+
+func toRecord(rr dns.RR) provider.Record {
+	rec := provider.Record{
+		Type: dns.TypeToString[rr.Header().Rrtype],
+		Name: strings.TrimSuffix(rr.Header().Name, "."),
+		TTL:  int(rr.Header().Ttl),
+	}
+
+	switch v := rr.(type) {
+	case *dns.A:
+		rec.Content = v.A.String()
+	case *dns.AAAA:
+		rec.Content = v.AAAA.String()
+	case *dns.TXT:
+		rec.Content = strings.Join(v.Txt, "")
+	}
+
+	// records have no identity besides their content
+	rec.ID = rec.Content
+	return rec
+}
+
+func (r *RFC2136) ttlFor(h host.Host) int {
+	if h.TTL > 0 {
+		return h.TTL
+	}
+	return r.ttl
+}
+
+// Fetch fetches the records of the given type for a host
+func (r *RFC2136) Fetch(h host.Host, recordType string) ([]provider.Record, error) {
+	logger.Debug("[RFC2136] Fetching %s record for host [%v]", recordType, h.Name)
+	rrType, ok := dns.StringToType[recordType]
+	if !ok {
+		err := fmt.Errorf("unsupported record type: [%s]", recordType)
+		logger.Debug(err.Error())
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(h.Name), rrType)
+	m.RecursionDesired = false
+	res, err := r.exchange(m)
+	if err != nil {
+		if res != nil && res.Rcode == dns.RcodeNameError {
+			return []provider.Record{}, nil
+		}
+		logger.Debug(err.Error())
+		return nil, err
+	}
+
+	result := make([]provider.Record, 0)
+	for _, rr := range res.Answer {
+		if rr.Header().Rrtype != rrType {
+			continue
+		}
+		rec := toRecord(rr)
+		logger.Debug("[RFC2136] IP Address for hostname [%s] is [%s]", rec.Name, rec.Content)
+		result = append(result, rec)
+	}
+
+	return result, nil
+}
+
+// Create adds a record of the given type for a host
+func (r *RFC2136) Create(h host.Host, recordType string, content string) (provider.Record, error) {
+	logger.Debug("[RFC2136] Creating %s record for host [%v]", recordType, h.Name)
+	rr, err := newRR(h.Name, recordType, r.ttlFor(h), content)
+	if err != nil {
+		logger.Debug(err.Error())
+		return provider.Record{}, err
+	}
+
+	err = r.update(h.Name, nil, rr)
+	if err != nil {
+		return provider.Record{}, err
+	}
+
+	return toRecord(rr), nil
+}
+
+// Update replaces an existing record of a host in a single dynamic update
+func (r *RFC2136) Update(rec provider.Record, h host.Host, content string) error {
+	logger.Debug("[RFC2136] Updating %s record for host [%v]", rec.Type, h.Name)
+	old, err := newRR(rec.Name, rec.Type, rec.TTL, rec.Content)
+	if err != nil {
+		logger.Debug(err.Error())
+		return err
+	}
+
+	rr, err := newRR(h.Name, rec.Type, r.ttlFor(h), content)
+	if err != nil {
+		logger.Debug(err.Error())
+		return err
+	}
+
+	return r.update(h.Name, old, rr)
+}
+
+// Delete removes an existing record
+func (r *RFC2136) Delete(rec provider.Record) error {
+	logger.Debug("[RFC2136] Deleting %s record [%s] for host [%v]", rec.Type, rec.Content, rec.Name)
+	old, err := newRR(rec.Name, rec.Type, rec.TTL, rec.Content)
+	if err != nil {
+		logger.Debug(err.Error())
+		return err
+	}
+
+	return r.update(rec.Name, old, nil)
+}
+
+// update sends a dynamic update removing and/or inserting a record
+func (r *RFC2136) update(name string, remove dns.RR, insert dns.RR) error {
+	zone, err := r.zoneFor(name)
+	if err != nil {
+		return err
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	if remove != nil {
+		m.Remove([]dns.RR{remove})
+	}
+	if insert != nil {
+		m.Insert([]dns.RR{insert})
+	}
+
+	_, err = r.exchange(m)
+	if err != nil {
+		logger.Debug(err.Error())
+	}
+	return err
+}
@@ -0,0 +1,275 @@
+package rfc2136
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kerti/cloudflare-ddns/config"
+	"github.com/kerti/cloudflare-ddns/host"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/provider"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	initloglevel uint8 = uint8(0)
+
+	testKeyName = "cf-ddns."
+	testSecret  = "c2VjcmV0LWtleS1mb3ItdGVzdGluZw=="
+	testZone    = "example.org."
+
+	checkConfigTestCases = []struct {
+		name      string
+		hostnames []string
+		server    string
+		keyName   string
+		secret    string
+		errIsNil  bool
+	}{
+		{
+			name:     "notInUse",
+			errIsNil: true,
+		},
+		{
+			name:      "serverOnly",
+			hostnames: []string{"home.example.org"},
+			server:    "127.0.0.1",
+			errIsNil:  true,
+		},
+		{
+			name:      "withTSIG",
+			hostnames: []string{"home.example.org"},
+			server:    "127.0.0.1",
+			keyName:   testKeyName,
+			secret:    testSecret,
+			errIsNil:  true,
+		},
+		{
+			name:      "noServer",
+			hostnames: []string{"home.example.org"},
+			errIsNil:  false,
+		},
+		{
+			name:      "keyNameWithoutSecret",
+			hostnames: []string{"home.example.org"},
+			server:    "127.0.0.1",
+			keyName:   testKeyName,
+			errIsNil:  false,
+		},
+	}
+)
+
+// nameserver is a minimal authoritative nameserver accepting signed updates
+type nameserver struct {
+	sync.Mutex
+	records []dns.RR
+	server  *dns.Server
+	addr    string
+}
+
+func newNameserver(t *testing.T) *nameserver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	ns := &nameserver{addr: pc.LocalAddr().String()}
+	started := make(chan struct{})
+	ns.server = &dns.Server{
+		PacketConn:        pc,
+		Handler:           ns,
+		TsigSecret:        map[string]string{testKeyName: testSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// the default accept func rejects dynamic updates
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go ns.server.ActivateAndServe()
+	<-started
+
+	return ns
+}
+
+func (ns *nameserver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+
+	if req.IsTsig() != nil {
+		if w.TsigStatus() != nil {
+			res.SetRcode(req, dns.RcodeNotAuth)
+			w.WriteMsg(res)
+			return
+		}
+		res.SetTsig(testKeyName, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	switch req.Opcode {
+	case dns.OpcodeUpdate:
+		if req.IsTsig() == nil {
+			res.SetRcode(req, dns.RcodeRefused)
+			break
+		}
+		for _, rr := range req.Ns {
+			if rr.Header().Class == dns.ClassNONE {
+				ns.remove(rr)
+			} else {
+				ns.records = append(ns.records, rr)
+			}
+		}
+	case dns.OpcodeQuery:
+		q := req.Question[0]
+		if !dns.IsSubDomain(testZone, q.Name) {
+			res.SetRcode(req, dns.RcodeRefused)
+			break
+		}
+		soa, _ := dns.NewRR(testZone + " 300 IN SOA ns.example.org. admin.example.org. 1 3600 600 86400 300")
+		if q.Qtype == dns.TypeSOA {
+			if q.Name == testZone {
+				res.Answer = append(res.Answer, soa)
+			} else {
+				res.Ns = append(res.Ns, soa)
+			}
+			break
+		}
+		for _, rr := range ns.records {
+			if rr.Header().Name == q.Name && rr.Header().Rrtype == q.Qtype {
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+	}
+
+	w.WriteMsg(res)
+}
+
+func (ns *nameserver) remove(rr dns.RR) {
+	removed := toRecord(rr)
+	records := make([]dns.RR, 0)
+	for _, existing := range ns.records {
+		rec := toRecord(existing)
+		if rec.Name == removed.Name && rec.Type == removed.Type && rec.Content == removed.Content {
+			continue
+		}
+		records = append(records, existing)
+	}
+	ns.records = records
+}
+
+func (ns *nameserver) contents() []string {
+	ns.Lock()
+	defer ns.Unlock()
+
+	result := make([]string, 0)
+	for _, rr := range ns.records {
+		rec := toRecord(rr)
+		result = append(result, rec.Type+" "+rec.Name+" "+rec.Content)
+	}
+	return result
+}
+
+func TestRFC2136(t *testing.T) {
+
+	logger.InitLogger(&initloglevel)
+	configFile := "../config.yaml"
+	config.Load(&configFile)
+
+	t.Run("CheckConfig", func(t *testing.T) {
+		for _, tc := range checkConfigTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				viper.Set("rfc2136.hostnames", tc.hostnames)
+				viper.Set("rfc2136.server", tc.server)
+				viper.Set("rfc2136.tsig.name", tc.keyName)
+				viper.Set("rfc2136.tsig.secret", tc.secret)
+				err := CheckConfig()
+				assert.Equal(t, tc.errIsNil, err == nil)
+			})
+		}
+	})
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		ns := newNameserver(t)
+		defer ns.server.Shutdown()
+
+		viper.Set("rfc2136.server", ns.addr)
+		viper.Set("rfc2136.tsig.name", testKeyName)
+		viper.Set("rfc2136.tsig.secret", testSecret)
+		viper.Set("rfc2136.tsig.algorithm", "hmac-sha256")
+
+		h := host.Host{Name: "home.example.org", TTL: 60}
+		r, err := New([]host.Host{h})
+		assert.Nil(t, err)
+
+		records, err := r.Fetch(h, "A")
+		assert.Nil(t, err)
+		assert.Empty(t, records)
+
+		rec, err := r.Create(h, "A", "1.2.3.4")
+		assert.Nil(t, err)
+		assert.Equal(t, provider.Record{ID: "1.2.3.4", Type: "A", Name: "home.example.org", Content: "1.2.3.4", TTL: 60}, rec)
+		assert.Equal(t, []string{"A home.example.org 1.2.3.4"}, ns.contents())
+
+		_, err = r.Create(h, "AAAA", "2001:db8::1")
+		assert.Nil(t, err)
+
+		records, err = r.Fetch(h, "A")
+		assert.Nil(t, err)
+		assert.Equal(t, []provider.Record{rec}, records)
+
+		err = r.Update(rec, h, "5.6.7.8")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"AAAA home.example.org 2001:db8::1", "A home.example.org 5.6.7.8"}, ns.contents())
+
+		records, err = r.Fetch(h, "AAAA")
+		assert.Nil(t, err)
+		assert.Len(t, records, 1)
+
+		err = r.Delete(records[0])
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"A home.example.org 5.6.7.8"}, ns.contents())
+	})
+
+	t.Run("zoneFor", func(t *testing.T) {
+		ns := newNameserver(t)
+		defer ns.server.Shutdown()
+
+		viper.Set("rfc2136.server", ns.addr)
+		viper.Set("rfc2136.tsig.name", "")
+		viper.Set("rfc2136.zone", "")
+
+		r, err := New([]host.Host{{Name: "override.example.org", ZoneID: "override.example.org"}})
+		assert.Nil(t, err)
+
+		zone, err := r.zoneFor("override.example.org")
+		assert.Nil(t, err)
+		assert.Equal(t, "override.example.org.", zone)
+
+		zone, err = r.zoneFor("home.example.org")
+		assert.Nil(t, err)
+		assert.Equal(t, testZone, zone)
+
+		_, err = r.zoneFor("home.example.com")
+		assert.NotNil(t, err)
+		assert.Equal(t, "nameserver ["+ns.addr+"] responded with REFUSED", err.Error())
+	})
+
+	t.Run("UnsignedUpdateRefused", func(t *testing.T) {
+		ns := newNameserver(t)
+		defer ns.server.Shutdown()
+
+		viper.Set("rfc2136.server", ns.addr)
+		viper.Set("rfc2136.tsig.name", "")
+		viper.Set("rfc2136.zone", testZone)
+
+		h := host.Host{Name: "home.example.org"}
+		r, err := New([]host.Host{h})
+		assert.Nil(t, err)
+
+		_, err = r.Create(h, "A", "1.2.3.4")
+		assert.NotNil(t, err)
+		assert.Equal(t, "nameserver ["+ns.addr+"] responded with REFUSED", err.Error())
+		assert.Empty(t, ns.contents())
+	})
+}
@@ -0,0 +1,257 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+
+	"github.com/kerti/cloudflare-ddns/host"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/provider"
+	"github.com/spf13/viper"
+)
+
+// Follow decides which records beyond the configured hosts follow the external
+// IP, being rewritten when they still point at the previous one
+type Follow struct {
+	Enabled   bool
+	Zones     []string
+	Exclude   []string
+	StateFile string
+}
+
+func getFollow() (Follow, error) {
+	f := Follow{
+		Enabled:   viper.GetBool("cloudflare.follow.enabled"),
+		Zones:     viper.GetStringSlice("cloudflare.follow.zones"),
+		Exclude:   viper.GetStringSlice("cloudflare.follow.exclude"),
+		StateFile: viper.GetString("cloudflare.follow.stateFile"),
+	}
+	if !f.Enabled {
+		return f, nil
+	}
+
+	if len(f.Zones) == 0 {
+		zoneID := viper.GetString("cloudflare.zoneID")
+		if len(zoneID) == 0 {
+			return f, fmt.Errorf("following the external IP requires at least one zone, check your config file")
+		}
+		f.Zones = []string{zoneID}
+	}
+
+	for _, pattern := range f.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return f, fmt.Errorf("invalid exclusion pattern for following the external IP: [%s]", pattern)
+		}
+	}
+
+	return f, nil
+}
+
+// excluded checks whether a hostname matches any of the exclusion patterns
+func (f Follow) excluded(name string) bool {
+	for _, pattern := range f.Exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// followedIP is a previous external IP, or a previous address derived from it,
+// along with its current counterpart the records still pointing at it are
+// moved to
+type followedIP struct {
+	Old     string
+	Current net.IP
+}
+
+// followedIPs returns the previous external IPs per record type, as resolved by
+// the worker and its uplinks, along with the previous addresses the hosts with
+// an IPv6 suffix derived from them. The content of the records is never taken
+// for a previous IP, as it may have been set by hand.
+func (w *Worker) followedIPs() map[string][]followedIP {
+	result := make(map[string][]followedIP)
+	seen := make(map[string]bool)
+	add := func(recordType string, ip net.IP, current net.IP) {
+		if ip == nil || current == nil || ip.Equal(current) || seen[recordType+"/"+ip.String()] {
+			return
+		}
+		seen[recordType+"/"+ip.String()] = true
+		result[recordType] = append(result[recordType], followedIP{Old: ip.String(), Current: current})
+	}
+
+	uplinks := []*Worker{w}
+	for _, name := range w.uplinkNames() {
+		uplinks = append(uplinks, w.Uplinks[name])
+	}
+	for _, u := range uplinks {
+		add(host.RecordTypeA, u.PreviousIP, u.CurrentIP)
+		add(host.RecordTypeAAAA, u.PreviousIPv6, u.CurrentIPv6)
+	}
+
+	for _, h := range w.Hosts {
+		previous := w.uplink(h).PreviousIPv6
+		if len(h.Suffix) == 0 || previous == nil {
+			continue
+		}
+		add(host.RecordTypeAAAA, withSuffix(previous, net.ParseIP(h.Suffix), w.prefixLength()), w.hostIP(h, host.RecordTypeAAAA))
+	}
+
+	return result
+}
+
+// publishedIPs are the external IPs of the worker or of an uplink, as kept in
+// the state file once all records following them were updated
+type publishedIPs struct {
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+// stateWorkers returns the worker and its uplinks by their key in the state
+// file, the worker itself having an empty one
+func (w *Worker) stateWorkers() map[string]*Worker {
+	result := map[string]*Worker{"": w}
+	for name, u := range w.Uplinks {
+		result[name] = u
+	}
+	return result
+}
+
+// restorePreviousIPs takes the external IPs kept in the state file for the
+// previous ones where they differ from the current ones, so that the records
+// still pointing at them are followed even right after a restart
+func (w *Worker) restorePreviousIPs() {
+	if !w.Follow.Enabled || len(w.Follow.StateFile) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(w.Follow.StateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	state := make(map[string]publishedIPs)
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		logger.Warn("[WORKER] Cannot read the state file [%s]: %s", w.Follow.StateFile, err.Error())
+		return
+	}
+	w.stateSaved = string(data)
+
+	for name, u := range w.stateWorkers() {
+		saved := state[name]
+		if ip := net.ParseIP(saved.IPv4); ip != nil && u.CurrentIP != nil && !ip.Equal(u.CurrentIP) && u.PreviousIP == nil {
+			u.PreviousIP = ip
+		}
+		if ip := net.ParseIP(saved.IPv6); ip != nil && u.CurrentIPv6 != nil && !ip.Equal(u.CurrentIPv6) && u.PreviousIPv6 == nil {
+			u.PreviousIPv6 = ip
+		}
+	}
+}
+
+// savePublishedIPs keeps the current external IPs in the state file, once
+// nothing follows the previous ones anymore
+func (w *Worker) savePublishedIPs() {
+	if !w.Follow.Enabled || len(w.Follow.StateFile) == 0 || !w.knowsIP() {
+		return
+	}
+
+	state := make(map[string]publishedIPs)
+	for name, u := range w.stateWorkers() {
+		saved := publishedIPs{}
+		if u.CurrentIP != nil {
+			saved.IPv4 = u.CurrentIP.String()
+		}
+		if u.CurrentIPv6 != nil {
+			saved.IPv6 = u.CurrentIPv6.String()
+		}
+		state[name] = saved
+	}
+	data, _ := json.Marshal(state)
+	if string(data) == w.stateSaved {
+		return
+	}
+
+	// write the state aside first, so that it is never left half written
+	temp := w.Follow.StateFile + ".tmp"
+	err := ioutil.WriteFile(temp, data, 0600)
+	if err == nil {
+		err = os.Rename(temp, w.Follow.StateFile)
+	}
+	if err != nil {
+		logger.Warn("[WORKER] Cannot write the state file [%s]: %s", w.Follow.StateFile, err.Error())
+		return
+	}
+	w.stateSaved = string(data)
+}
+
+// planFollow returns the updates of the records in the followed zones still
+// pointing at a previous external IP. Records of the configured hosts are left
+// to their own policy. It also tells whether all zones could be searched.
+func (w *Worker) planFollow(report *Report) ([]Change, bool) {
+	if !w.Follow.Enabled {
+		return nil, true
+	}
+
+	searcher, ok := w.Providers[host.ProviderCloudflare].(provider.ZoneSearcher)
+	if !ok {
+		return nil, true
+	}
+
+	// only the hostnames published on Cloudflare DNS are found in its zones
+	managed := make(map[string]bool)
+	for _, h := range w.Hosts {
+		if h.Provider == host.ProviderCloudflare {
+			managed[h.Name] = true
+		}
+	}
+
+	changes := make([]Change, 0)
+	complete := true
+	followed := w.followedIPs()
+	for _, recordType := range []string{host.RecordTypeA, host.RecordTypeAAAA} {
+		for _, zone := range w.Follow.Zones {
+			for _, f := range followed[recordType] {
+				records, err := searcher.Search(zone, recordType, f.Old)
+				if err != nil {
+					report.failed("failed to search zone [%s] for %s records with [%s]: %s", zone, recordType, f.Old, err.Error())
+					complete = false
+					continue
+				}
+
+				for _, rec := range records {
+					if !sameIP(rec.Content, net.ParseIP(f.Old)) || managed[rec.Name] || w.Follow.excluded(rec.Name) {
+						continue
+					}
+					if change, ok := newUpdate(followHost(rec), rec, f.Current); ok {
+						change.Followed = true
+						changes = append(changes, change)
+					}
+				}
+			}
+		}
+	}
+
+	return changes, complete
+}
+
+// followHost returns the host a followed record belongs to. It configures no
+// attributes, so that only the content of the record is changed.
+func followHost(rec provider.Record) host.Host {
+	family := host.FamilyIPv4
+	if rec.Type == host.RecordTypeAAAA {
+		family = host.FamilyIPv6
+	}
+
+	return host.Host{
+		Name:     rec.Name,
+		Provider: host.ProviderCloudflare,
+		Family:   family,
+		Policy:   host.PolicyEnsurePresent,
+	}
+}
@@ -0,0 +1,237 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/resolver"
+	"github.com/spf13/viper"
+)
+
+// now is the clock of the circuit breaker, so that tests can move it
+var now = time.Now
+
+// Breaker decides after how many failures in a row a resolver is skipped, and
+// for how long
+type Breaker struct {
+	Threshold   int
+	CoolDown    time.Duration
+	MaxCoolDown time.Duration
+}
+
+func getBreaker() Breaker {
+	b := Breaker{
+		Threshold:   viper.GetInt("resolver.breaker.threshold"),
+		CoolDown:    viper.GetDuration("resolver.breaker.coolDown"),
+		MaxCoolDown: viper.GetDuration("resolver.breaker.maxCoolDown"),
+	}
+	if b.MaxCoolDown < b.CoolDown {
+		b.MaxCoolDown = b.CoolDown
+	}
+	return b
+}
+
+// coolDown returns how long a resolver is skipped after its circuit opened the
+// given number of times in a row, doubling every time
+func (b Breaker) coolDown(trips int) time.Duration {
+	coolDown := b.CoolDown
+	for i := 1; i < trips && coolDown < b.MaxCoolDown; i++ {
+		coolDown *= 2
+	}
+	if coolDown > b.MaxCoolDown {
+		coolDown = b.MaxCoolDown
+	}
+	return coolDown
+}
+
+// ResolverHealth keeps track of how well a resolver has been answering
+type ResolverHealth struct {
+	Successes           int
+	Failures            int
+	ConsecutiveFailures int
+	Latency             time.Duration
+	LastError           string
+	Trips               int
+	OpenUntil           time.Time
+}
+
+// SuccessRate returns the share of queries the resolver answered, between 0
+// and 1, or 1 if it has not been queried yet
+func (h ResolverHealth) SuccessRate() float64 {
+	if h.Successes+h.Failures == 0 {
+		return 1
+	}
+	return float64(h.Successes) / float64(h.Successes+h.Failures)
+}
+
+// IsOpen checks whether the circuit of the resolver is open, i.e. whether it
+// is still cooling down
+func (h ResolverHealth) IsOpen() bool {
+	return now().Before(h.OpenUntil)
+}
+
+func (h ResolverHealth) String() string {
+	result := fmt.Sprintf("success rate: %.0f%%, latency: %s", 100*h.SuccessRate(), h.Latency.Round(time.Millisecond))
+	if len(h.LastError) > 0 {
+		result += ", last error: " + h.LastError
+	}
+	if h.IsOpen() {
+		result += ", cooling down until " + h.OpenUntil.Format(time.RFC3339)
+	}
+	return result
+}
+
+// ResolverHealth returns a copy of the health of all resolvers queried so far,
+// including those of the uplinks, keyed by <uplink>/<resolver> as the same
+// resolver may be used on several uplinks
+func (w *Worker) ResolverHealth() map[string]ResolverHealth {
+	result := make(map[string]ResolverHealth)
+	for uplink, u := range w.Uplinks {
+		for name, h := range u.ResolverHealth() {
+			result[uplink+"/"+name] = h
+		}
+	}
+
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	for name, h := range w.Health {
+		result[name] = *h
+	}
+	return result
+}
+
+func (w *Worker) health(name string) *ResolverHealth {
+	if w.Health == nil {
+		w.Health = make(map[string]*ResolverHealth)
+	}
+	h, ok := w.Health[name]
+	if !ok {
+		h = &ResolverHealth{}
+		w.Health[name] = h
+	}
+	return h
+}
+
+// isOpen checks whether the resolver is cooling down
+func (w *Worker) isOpen(name string) bool {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	return w.health(name).IsOpen()
+}
+
+// queryResolver asks the resolver for the external IP, and keeps track of
+// its health. Once it failed often enough in a row, its circuit opens and it
+// is skipped until it cooled down. It is then tried once more, and cools down
+// twice as long if it fails again. Answers failing the validation count as
+// failures.
+func (w *Worker) queryResolver(rslv resolver.Resolver) (net.IP, error) {
+	started := now()
+	ip, err := rslv.GetExternalIP()
+	latency := now().Sub(started)
+	if reason := w.Validation.reject(ip); err == nil && len(reason) > 0 {
+		err = fmt.Errorf("resolver [%s] answered [%s], %s", rslv.Name, ip, reason)
+		logger.Warn("[WORKER] %s", err.Error())
+	}
+
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+
+	h := w.health(rslv.Name)
+	if err == nil {
+		if h.Trips > 0 {
+			logger.Info("[WORKER] Resolver [%s] recovered.", rslv.Name)
+		}
+		h.Successes++
+		h.ConsecutiveFailures = 0
+		h.Trips = 0
+		h.OpenUntil = time.Time{}
+		// smooth the latency out over the last few queries
+		if h.Latency == 0 {
+			h.Latency = latency
+		} else {
+			h.Latency = (3*h.Latency + latency) / 4
+		}
+		return ip, nil
+	}
+
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.LastError = err.Error()
+	if w.Breaker.Threshold > 0 && h.ConsecutiveFailures >= w.Breaker.Threshold {
+		h.Trips++
+		coolDown := w.Breaker.coolDown(h.Trips)
+		h.OpenUntil = now().Add(coolDown)
+		logger.Warn("[WORKER] Resolver [%s] failed %d time(s) in a row, skipping it for %s.", rslv.Name, h.ConsecutiveFailures, coolDown)
+	}
+	return nil, err
+}
+
+// getExternalIPRoundRobin asks the resolver whose turn it is for the external
+// IP. When it fails or is cooling down, the next resolvers of the same address
+// family are asked in turn. When all of them are cooling down, the one whose
+// turn it is is asked anyway, so that an outage on this end does not keep all
+// resolvers sidelined for long.
+func (w *Worker) getExternalIPRoundRobin() error {
+	if len(w.Resolvers) == 0 {
+		return fmt.Errorf("no resolvers configured")
+	}
+
+	if w.Counter >= len(w.Resolvers) {
+		w.Counter = 0
+	}
+	start := w.Counter
+	w.Counter++
+
+	turn := w.Resolvers[start]
+	candidates := make([]resolver.Resolver, 0)
+	for i := 0; i < len(w.Resolvers); i++ {
+		rslv := w.Resolvers[(start+i)%len(w.Resolvers)]
+		if rslv.IsIPv6() != turn.IsIPv6() {
+			continue
+		}
+		if w.isOpen(rslv.Name) {
+			logger.Debug("[WORKER] Resolver [%s] is cooling down, skipping it.", rslv.Name)
+			continue
+		}
+		candidates = append(candidates, rslv)
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, turn)
+	}
+
+	var err error
+	for i, rslv := range candidates {
+		var externalIP net.IP
+		externalIP, err = w.queryResolver(rslv)
+		if err != nil {
+			if i < len(candidates)-1 {
+				logger.Warn("[WORKER] Resolver [%s] failed, trying [%s]: %s", rslv.Name, candidates[i+1].Name, err.Error())
+			}
+			continue
+		}
+
+		w.setCurrentIP(externalIP)
+		return nil
+	}
+
+	return err
+}
+
+// logHealth logs how often each resolver dissented from the quorum, and the
+// health of all resolvers queried so far. The prefix names the uplink.
+func (w *Worker) logHealth(prefix string) {
+	for _, rslv := range w.Resolvers {
+		if count := w.Dissents[rslv.Name]; count > 0 {
+			logger.Debug("[WORKER] Resolver [%s%s] dissented from the quorum %d time(s)", prefix, rslv.Name, count)
+		}
+	}
+
+	health := w.ResolverHealth()
+	for _, rslv := range w.Resolvers {
+		if h, ok := health[rslv.Name]; ok {
+			logger.Debug("[WORKER] Resolver [%s%s] %s", prefix, rslv.Name, h.String())
+		}
+	}
+}
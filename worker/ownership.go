@@ -0,0 +1,202 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kerti/cloudflare-ddns/host"
+	"github.com/kerti/cloudflare-ddns/provider"
+	"github.com/spf13/viper"
+)
+
+const (
+	// OwnershipOff manages every record of the configured hosts
+	OwnershipOff = "off"
+	// OwnershipComment marks owned records with the marker in their comment
+	OwnershipComment = "comment"
+	// OwnershipTXT marks owned hosts with a companion TXT record holding the marker
+	OwnershipTXT = "txt"
+
+	// markerPrefix is prepended to the hostname to get its companion TXT record
+	markerPrefix = "_cfddns."
+)
+
+// Ownership decides which records the worker is allowed to change
+type Ownership struct {
+	Mode       string
+	InstanceID string
+}
+
+func getOwnership() (Ownership, error) {
+	o := Ownership{
+		Mode:       strings.ToLower(viper.GetString("ownership.mode")),
+		InstanceID: viper.GetString("ownership.instanceID"),
+	}
+
+	switch o.Mode {
+	case "":
+		o.Mode = OwnershipOff
+	case OwnershipOff, OwnershipComment, OwnershipTXT:
+	default:
+		return o, fmt.Errorf("unsupported ownership mode: [%s]", o.Mode)
+	}
+
+	return o, nil
+}
+
+// marker returns the text identifying the records owned by this instance
+func (o Ownership) marker() string {
+	return "heritage=cloudflare-ddns,instance=" + o.InstanceID
+}
+
+// marks checks whether the text is the marker of this instance, alone or after
+// a comment as added by prepareHosts. The instance ID must match as a whole, so
+// that instance "a" does not claim the records of instance "ab".
+func (o Ownership) marks(text string) bool {
+	return text == o.marker() || strings.HasSuffix(text, " ("+o.marker()+")")
+}
+
+// applies checks whether the ownership of a host's records is tracked at all.
+// The items of an IP List are always ours, as only those carrying our comment
+// are ever fetched.
+func (o Ownership) applies(h host.Host) bool {
+	managed := o.Mode == OwnershipComment || o.Mode == OwnershipTXT
+	return managed && h.Provider != host.ProviderCloudflareIPList
+}
+
+// prepareHosts adds the marker to the comment of every host in comment mode
+func (o Ownership) prepareHosts(hosts []host.Host) error {
+	if o.Mode != OwnershipComment {
+		return nil
+	}
+
+	for i, h := range hosts {
+		if !o.applies(h) {
+			continue
+		}
+		if h.Provider != host.ProviderCloudflare {
+			return fmt.Errorf("ownership mode [%s] is not supported for host [%s] of provider [%s], use [%s]", o.Mode, h.Name, h.Provider, OwnershipTXT)
+		}
+
+		if len(h.Comment) == 0 {
+			hosts[i].Comment = o.marker()
+		} else {
+			hosts[i].Comment = h.Comment + " (" + o.marker() + ")"
+		}
+	}
+
+	return nil
+}
+
+// markerHosts returns the companion TXT hosts of the hosts in TXT mode
+func (o Ownership) markerHosts(hosts []host.Host) []host.Host {
+	result := make([]host.Host, 0)
+	if o.Mode != OwnershipTXT {
+		return result
+	}
+
+	for _, h := range hosts {
+		if o.applies(h) {
+			result = append(result, markerHost(h))
+		}
+	}
+	return result
+}
+
+func markerHost(h host.Host) host.Host {
+	return host.Host{
+		Name:     markerPrefix + h.Name,
+		Provider: h.Provider,
+		Family:   h.Family,
+		Policy:   host.PolicySingle,
+		ZoneID:   h.ZoneID,
+		TTL:      h.TTL,
+	}
+}
+
+// hasMarker checks whether the companion TXT record of a host holds our marker
+func (w *Worker) hasMarker(h host.Host) bool {
+	for _, rec := range w.records(recordKey(h.Provider, markerPrefix+h.Name, "TXT")) {
+		if w.Ownership.marks(strings.Trim(rec.Content, `"`)) {
+			return true
+		}
+	}
+	return false
+}
+
+// owns checks whether a record of the host carries our marker. In TXT mode,
+// all records of a host are owned once its companion record holds the marker.
+func (w *Worker) owns(h host.Host, rec provider.Record) bool {
+	if !w.Ownership.applies(h) {
+		return true
+	}
+
+	if w.Ownership.Mode == OwnershipComment {
+		return w.Ownership.marks(rec.Comment)
+	}
+	return w.hasMarker(h)
+}
+
+// checkOwnership refuses the changes to records of the host not owned by us,
+// unless the host adopts them
+func (w *Worker) checkOwnership(h host.Host, changes []Change) []Change {
+	if !w.Ownership.applies(h) {
+		return changes
+	}
+
+	if w.Ownership.Mode == OwnershipTXT {
+		return w.checkMarker(h, changes)
+	}
+
+	for i, change := range changes {
+		if change.Action == ActionCreate || h.Adopt || w.owns(h, change.record) {
+			continue
+		}
+		changes[i].Refused = fmt.Sprintf("%s record [%s] of host [%s] is not owned by instance [%s], set adopt on the host to take it over",
+			change.Type, change.OldContent, h.Name, w.Ownership.InstanceID)
+	}
+
+	return changes
+}
+
+// checkMarker handles ownership in TXT mode, where a host is owned as a whole.
+// A host without any record becomes ours with the first record we add, along
+// with its companion record. The companion record is created first, and the
+// other changes are skipped when that fails, so that a host never ends up with
+// records it does not own. A host having records without the companion record
+// is left alone entirely, unless adopted.
+func (w *Worker) checkMarker(h host.Host, changes []Change) []Change {
+	if w.hasMarker(h) {
+		return changes
+	}
+
+	existing := false
+	for _, recordType := range h.RecordTypes() {
+		if len(w.records(recordKey(h.Provider, h.Name, recordType))) > 0 {
+			existing = true
+		}
+	}
+
+	if existing && !h.Adopt {
+		for i := range changes {
+			changes[i].Refused = fmt.Sprintf("host [%s] has records not owned by instance [%s], set adopt on the host to take them over",
+				h.Name, w.Ownership.InstanceID)
+		}
+		return changes
+	}
+
+	if len(changes) == 0 && !existing {
+		return changes
+	}
+
+	marker := markerHost(h)
+	return append([]Change{{
+		Action:     ActionCreate,
+		Host:       marker.Name,
+		Provider:   marker.Provider,
+		Type:       "TXT",
+		NewContent: w.Ownership.marker(),
+		host:       marker,
+		required:   true,
+	}}, changes...)
+}
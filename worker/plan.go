@@ -0,0 +1,482 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kerti/cloudflare-ddns/host"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/provider"
+)
+
+const (
+	// ActionCreate adds a new record
+	ActionCreate = "create"
+	// ActionUpdate updates an existing record
+	ActionUpdate = "update"
+	// ActionDelete deletes an existing record
+	ActionDelete = "delete"
+
+	// PlanFormatText prints the plan as a human readable diff
+	PlanFormatText = "text"
+	// PlanFormatJSON prints the plan as JSON
+	PlanFormatJSON = "json"
+)
+
+// Change is a single change the worker makes to the records of a host
+type Change struct {
+	Action     string        `json:"action"`
+	Host       string        `json:"host"`
+	Provider   string        `json:"provider"`
+	Type       string        `json:"type"`
+	OldContent string        `json:"oldContent,omitempty"`
+	NewContent string        `json:"newContent,omitempty"`
+	Proxied    *BoolChange   `json:"proxied,omitempty"`
+	TTL        *IntChange    `json:"ttl,omitempty"`
+	Comment    *StringChange `json:"comment,omitempty"`
+	Refused    string        `json:"refused,omitempty"`
+	Followed   bool          `json:"followed,omitempty"`
+
+	host     host.Host
+	record   provider.Record
+	replaces string
+	// required tells that the remaining changes of the host depend on it
+	required bool
+}
+
+// BoolChange is the old and new value of a boolean attribute
+type BoolChange struct {
+	Old bool `json:"old"`
+	New bool `json:"new"`
+}
+
+// IntChange is the old and new value of a numeric attribute
+type IntChange struct {
+	Old int `json:"old"`
+	New int `json:"new"`
+}
+
+// StringChange is the old and new value of a text attribute
+type StringChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// plan returns the changes needed to bring the records of all hosts up to date
+func (w *Worker) plan() []Change {
+	changes := make([]Change, 0)
+	for _, hostChanges := range w.planHosts() {
+		changes = append(changes, hostChanges...)
+	}
+	return changes
+}
+
+// planHosts returns the changes needed per host, in the order of the hosts.
+// The changes to the companion record of a host are part of its own changes.
+// Hosts whose records or companion record could not be fetched are left alone,
+// as nothing tells whether the records there are ours.
+func (w *Worker) planHosts() [][]Change {
+	result := make([][]Change, 0, len(w.Hosts))
+	for _, h := range w.Hosts {
+		if key, ok := w.unreadable(h); ok {
+			logger.Warn("[WORKER] Records [%s] of host [%s] could not be fetched, skipping the host...", key, h.Name)
+			result = append(result, nil)
+			continue
+		}
+
+		hostChanges := make([]Change, 0)
+		for _, recordType := range h.RecordTypes() {
+			hostChanges = append(hostChanges, w.planHost(h, recordType)...)
+		}
+		result = append(result, w.checkOwnership(h, hostChanges))
+	}
+	return result
+}
+
+func (w *Worker) planHost(h host.Host, recordType string) []Change {
+	currentIP := w.hostIP(h, recordType)
+	if currentIP == nil {
+		logger.Debug("[WORKER] No external IP known for %s record of host [%s], skipping...", recordType, h.Name)
+		return nil
+	}
+	if !h.Permits(currentIP) {
+		logger.Warn("[WORKER] External IP [%s] is not permitted for host [%s], skipping...", currentIP, h.Name)
+		return nil
+	}
+
+	records := w.records(recordKey(h.Provider, h.Name, recordType))
+	switch h.Policy {
+	case host.PolicyEnsurePresent:
+		return planEnsurePresent(h, recordType, currentIP, records)
+	case host.PolicyReplaceAll:
+		return planReplaceAll(h, recordType, currentIP, records)
+	default:
+		return planSingle(h, recordType, currentIP, records)
+	}
+}
+
+// planSingle keeps one record for the host, preferably the one already holding
+// the current IP, and deletes all others
+func planSingle(h host.Host, recordType string, currentIP net.IP, records []provider.Record) []Change {
+	if len(records) == 0 {
+		logger.Debug("[WORKER] Host [%s] has no %s record, adding...", h.Name, recordType)
+		return []Change{newCreate(h, recordType, currentIP)}
+	}
+
+	keep := 0
+	for i, rec := range records {
+		if sameIP(rec.Content, currentIP) {
+			keep = i
+			break
+		}
+	}
+
+	changes := make([]Change, 0)
+	if change, ok := newUpdate(h, records[keep], currentIP); ok {
+		changes = append(changes, change)
+	}
+
+	if len(records) > 1 {
+		logger.Debug("[WORKER] Host [%s] has %d %s records, deleting duplicates...", h.Name, len(records), recordType)
+	}
+	for i, rec := range records {
+		if i != keep {
+			changes = append(changes, newDelete(h, rec))
+		}
+	}
+
+	return changes
+}
+
+// planEnsurePresent makes sure one of the records of the host holds the current IP
+func planEnsurePresent(h host.Host, recordType string, currentIP net.IP, records []provider.Record) []Change {
+	for _, rec := range records {
+		if sameIP(rec.Content, currentIP) {
+			if change, ok := newUpdate(h, rec, currentIP); ok {
+				return []Change{change}
+			}
+			return nil
+		}
+	}
+
+	logger.Debug("[WORKER] Host [%s] has no %s record with [%s] among %d record(s), adding...", h.Name, recordType, currentIP, len(records))
+	return []Change{newCreate(h, recordType, currentIP)}
+}
+
+// planReplaceAll makes a record holding the current IP the only record of the
+// host. The new record is added before the others are deleted, so that the host
+// keeps resolving in between.
+func planReplaceAll(h host.Host, recordType string, currentIP net.IP, records []provider.Record) []Change {
+	changes := make([]Change, 0)
+	found := false
+	stale := make([]provider.Record, 0)
+	for _, rec := range records {
+		if !found && sameIP(rec.Content, currentIP) {
+			if change, ok := newUpdate(h, rec, currentIP); ok {
+				changes = append(changes, change)
+			}
+			found = true
+			continue
+		}
+		stale = append(stale, rec)
+	}
+
+	if !found {
+		logger.Debug("[WORKER] Host [%s] has no %s record with [%s], adding...", h.Name, recordType, currentIP)
+		change := newCreate(h, recordType, currentIP)
+		if len(stale) > 0 {
+			change.replaces = stale[0].Content
+		}
+		changes = append(changes, change)
+	}
+
+	if len(stale) > 0 {
+		logger.Debug("[WORKER] Host [%s] has %d other %s record(s), deleting...", h.Name, len(stale), recordType)
+	}
+	for _, rec := range stale {
+		changes = append(changes, newDelete(h, rec))
+	}
+
+	return changes
+}
+
+func newCreate(h host.Host, recordType string, currentIP net.IP) Change {
+	return Change{
+		Action:     ActionCreate,
+		Host:       h.Name,
+		Provider:   h.Provider,
+		Type:       recordType,
+		NewContent: currentIP.String(),
+		host:       h,
+	}
+}
+
+// newUpdate returns the update of a record of the host, if its content or its
+// configured attributes differ
+func newUpdate(h host.Host, rec provider.Record, currentIP net.IP) (Change, bool) {
+	if sameIP(rec.Content, currentIP) && !attributesChanged(h, rec) {
+		logger.Debug("[WORKER] Host [%s] has correct %s record set, skipping...", h.Name, rec.Type)
+		return Change{}, false
+	}
+
+	logger.Debug("[WORKER] Host [%s] has different %s record, setting...", h.Name, rec.Type)
+	updated := updatedRecord(h, rec, currentIP)
+	change := Change{
+		Action:     ActionUpdate,
+		Host:       h.Name,
+		Provider:   h.Provider,
+		Type:       rec.Type,
+		OldContent: rec.Content,
+		NewContent: updated.Content,
+		host:       h,
+		record:     rec,
+	}
+	if updated.Proxied != rec.Proxied {
+		change.Proxied = &BoolChange{Old: rec.Proxied, New: updated.Proxied}
+	}
+	if updated.TTL != rec.TTL && !updated.Proxied {
+		change.TTL = &IntChange{Old: rec.TTL, New: updated.TTL}
+	}
+	if updated.Comment != rec.Comment {
+		change.Comment = &StringChange{Old: rec.Comment, New: updated.Comment}
+	}
+
+	return change, true
+}
+
+func newDelete(h host.Host, rec provider.Record) Change {
+	return Change{
+		Action:     ActionDelete,
+		Host:       h.Name,
+		Provider:   h.Provider,
+		Type:       rec.Type,
+		OldContent: rec.Content,
+		host:       h,
+		record:     rec,
+	}
+}
+
+// apply applies the changes in order, and tells whether all of them were
+// applied. When a change fails, the remaining changes of the same host and
+// record type are skipped, or all remaining changes when it was required.
+func (w *Worker) apply(changes []Change, report *Report) bool {
+	failed := make(map[string]bool)
+	blocked := false
+	for _, change := range changes {
+		key := recordKey(change.Provider, change.Host, change.Type)
+		if failed[key] || blocked {
+			report.skipped(change)
+			continue
+		}
+
+		if len(change.Refused) > 0 {
+			report.refused(change.Refused)
+			failed[key] = true
+			continue
+		}
+
+		err := w.applyChange(change)
+		if err != nil {
+			report.failed("failed to %s %s record of host [%s]: %s", change.Action, change.Type, change.Host, err.Error())
+			failed[key] = true
+			blocked = change.required
+			continue
+		}
+		report.applied(change)
+	}
+
+	return len(failed) == 0
+}
+
+// applyChange applies a single change. It runs on the worker pool, so the
+// notification is sent right away instead of from yet another goroutine.
+func (w *Worker) applyChange(change Change) error {
+	h := change.host
+	p := w.Providers[h.Provider]
+	key := recordKey(h.Provider, h.Name, change.Type)
+
+	switch change.Action {
+	case ActionCreate:
+		rec, err := p.Create(h, change.Type, change.NewContent)
+		if err != nil {
+			return err
+		}
+		logger.Info("[WORKER] Created %s record [%s] for host [%s]", change.Type, change.NewContent, h.Name)
+
+		w.hostMapLock.Lock()
+		w.HostMap[key] = append(w.HostMap[key], rec)
+		w.hostMapLock.Unlock()
+		if len(change.replaces) > 0 {
+			w.notify(h.Name, change.replaces, change.NewContent)
+		}
+	case ActionUpdate:
+		err := p.Update(change.record, h, change.NewContent)
+		if err != nil {
+			return err
+		}
+
+		// followed records are not tracked, and are listed in the report instead
+		if change.Followed {
+			return nil
+		}
+		logger.Info("[WORKER] Updated %s record of host [%s] from [%s] to [%s]", change.Type, h.Name, change.OldContent, change.NewContent)
+
+		w.replaceRecord(key, change.record, updatedRecord(h, change.record, net.ParseIP(change.NewContent)))
+		if change.OldContent != change.NewContent {
+			w.notify(h.Name, change.OldContent, change.NewContent)
+		}
+	case ActionDelete:
+		err := p.Delete(change.record)
+		if err != nil {
+			return err
+		}
+		logger.Info("[WORKER] Deleted %s record [%s] of host [%s]", change.Type, change.OldContent, h.Name)
+
+		w.replaceRecord(key, change.record, nil)
+	}
+
+	return nil
+}
+
+// replaceRecord replaces a known record, or removes it when the replacement is nil
+func (w *Worker) replaceRecord(key string, old provider.Record, replacement *provider.Record) {
+	w.hostMapLock.Lock()
+	defer w.hostMapLock.Unlock()
+
+	records := make([]provider.Record, 0)
+	for _, rec := range w.HostMap[key] {
+		if rec.ID == old.ID && rec.Content == old.Content {
+			if replacement == nil {
+				continue
+			}
+			rec = *replacement
+		}
+		records = append(records, rec)
+	}
+	w.HostMap[key] = records
+}
+
+// attributesChanged checks whether the configured attributes of a host differ
+// from the ones of its record. Attributes that are not configured never differ.
+func attributesChanged(h host.Host, rec provider.Record) bool {
+	if h.Proxied != nil && *h.Proxied != rec.Proxied {
+		return true
+	}
+
+	// proxied records always have an automatic TTL
+	if h.TTL > 0 && h.TTL != rec.TTL && !h.IsProxied(rec.Proxied) {
+		return true
+	}
+
+	if len(h.Comment) > 0 && h.Comment != rec.Comment {
+		return true
+	}
+
+	return false
+}
+
+// updatedRecord returns the record as it is after being updated for the host
+func updatedRecord(h host.Host, rec provider.Record, newIP net.IP) *provider.Record {
+	rec.Content = newIP.String()
+	rec.Proxied = h.IsProxied(rec.Proxied)
+	if h.TTL > 0 {
+		rec.TTL = h.TTL
+	}
+	if len(h.Comment) > 0 {
+		rec.Comment = h.Comment
+	}
+	return &rec
+}
+
+func sameIP(content string, ip net.IP) bool {
+	parsed := net.ParseIP(content)
+	return parsed != nil && parsed.Equal(ip)
+}
+
+// WritePlan writes the changes in the given format
+func WritePlan(out io.Writer, changes []Change, format string) error {
+	switch format {
+	case PlanFormatJSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(changes)
+	case PlanFormatText:
+		return writePlanText(out, changes)
+	default:
+		return fmt.Errorf("unsupported plan format: [%s]", format)
+	}
+}
+
+func writePlanText(out io.Writer, changes []Change) error {
+	if len(changes) == 0 {
+		_, err := fmt.Fprintln(out, "No changes, all records are up to date.")
+		return err
+	}
+
+	counts := make(map[string]int)
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, change := range changes {
+		counts[change.Action]++
+
+		var symbol, content string
+		switch change.Action {
+		case ActionCreate:
+			symbol, content = "+", change.NewContent
+		case ActionDelete:
+			symbol, content = "-", change.OldContent
+		default:
+			symbol, content = "~", change.OldContent
+			if change.OldContent != change.NewContent {
+				content += " -> " + change.NewContent
+			}
+		}
+
+		if len(change.Refused) > 0 {
+			counts[change.Action]--
+			counts["refused"]++
+			symbol = "!"
+		}
+
+		line := strings.Join([]string{symbol, change.Type, change.Host, content}, "\t")
+		if attributes := describeAttributes(change); len(attributes) > 0 {
+			line += "\t" + attributes
+		}
+		fmt.Fprintln(tw, line)
+	}
+
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	summary := fmt.Sprintf("Plan: %d to create, %d to update, %d to delete", counts[ActionCreate], counts[ActionUpdate], counts[ActionDelete])
+	if counts["refused"] > 0 {
+		summary += fmt.Sprintf(", %d refused", counts["refused"])
+	}
+	_, err = fmt.Fprintf(out, "\n%s.\n", summary)
+	return err
+}
+
+func describeAttributes(change Change) string {
+	attributes := make([]string, 0)
+	if len(change.Refused) > 0 {
+		attributes = append(attributes, "refused: "+change.Refused)
+	}
+	if change.Followed {
+		attributes = append(attributes, "followed")
+	}
+	if change.Proxied != nil {
+		attributes = append(attributes, fmt.Sprintf("proxied: %t -> %t", change.Proxied.Old, change.Proxied.New))
+	}
+	if change.TTL != nil {
+		attributes = append(attributes, fmt.Sprintf("ttl: %d -> %d", change.TTL.Old, change.TTL.New))
+	}
+	if change.Comment != nil {
+		attributes = append(attributes, fmt.Sprintf("comment: %q -> %q", change.Comment.Old, change.Comment.New))
+	}
+	return strings.Join(attributes, ", ")
+}
@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/spf13/viper"
+)
+
+// runPool runs the jobs on at most the given number of goroutines, and returns
+// once all of them are done
+func runPool(concurrency int, jobs []func()) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(job func()) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			job()
+		}(job)
+	}
+	wg.Wait()
+}
+
+func getConcurrency() int {
+	concurrency := viper.GetInt("worker.concurrency")
+	if concurrency < 1 {
+		logger.Warn("[WORKER] Invalid concurrency: [%d], reverting to 1.", concurrency)
+		concurrency = 1
+	}
+	return concurrency
+}
+
+// Report collects the outcome of a cycle, so that it can be logged at once
+// instead of interleaved with the other hosts
+type Report struct {
+	lock     sync.Mutex
+	started  time.Time
+	Fetched  int
+	Applied  int
+	Failed   int
+	Refused  int
+	Skipped  int
+	Errors   []string
+	Followed []string
+}
+
+func newReport() *Report {
+	return &Report{started: time.Now(), Errors: make([]string, 0), Followed: make([]string, 0)}
+}
+
+func (r *Report) fetched(count int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Fetched += count
+}
+
+func (r *Report) applied(change Change) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Applied++
+	if change.Followed {
+		r.Followed = append(r.Followed, fmt.Sprintf("%s %s [%s] -> [%s]", change.Type, change.Host, change.OldContent, change.NewContent))
+	}
+}
+
+func (r *Report) failed(format string, v ...interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Failed++
+	r.Errors = append(r.Errors, fmt.Sprintf(format, v...))
+}
+
+func (r *Report) refused(reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Refused++
+	r.Errors = append(r.Errors, "refused: "+reason)
+}
+
+func (r *Report) skipped(change Change) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Skipped++
+	r.Errors = append(r.Errors, fmt.Sprintf("skipped %s of %s record of host [%s] after an earlier failure", change.Action, change.Type, change.Host))
+}
+
+// log logs the summary of the cycle, along with its errors if there are any
+func (r *Report) log() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.Followed) > 0 {
+		logger.Info("[WORKER] Followed the external IP in %d record(s):\n  %s", len(r.Followed), strings.Join(r.Followed, "\n  "))
+	}
+
+	summary := fmt.Sprintf("[WORKER] Cycle complete in %s: %d record(s) fetched, %d change(s) applied, %d failed, %d refused, %d skipped.",
+		time.Since(r.started).Round(time.Millisecond), r.Fetched, r.Applied, r.Failed, r.Refused, r.Skipped)
+	if len(r.Errors) == 0 {
+		logger.Info("%s", summary)
+		return
+	}
+
+	logger.Error("%s\n  %s", summary, strings.Join(r.Errors, "\n  "))
+}
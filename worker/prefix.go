@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/kerti/cloudflare-ddns/host"
+	"github.com/spf13/viper"
+)
+
+// defaultPrefixLength is the length of the delegated IPv6 prefix when the
+// worker has none configured
+const defaultPrefixLength = 64
+
+func getPrefixLength() (int, error) {
+	length := viper.GetInt("resolver.prefixLength")
+	if length < 1 || length > 8*net.IPv6len {
+		return 0, fmt.Errorf("invalid delegated IPv6 prefix length: [%d]", length)
+	}
+	return length, nil
+}
+
+func (w *Worker) prefixLength() int {
+	if w.PrefixLength <= 0 {
+		return defaultPrefixLength
+	}
+	return w.PrefixLength
+}
+
+// withSuffix combines the leading bits of the IPv6 address, making up the
+// delegated prefix, with the remaining bits of the suffix
+func withSuffix(ip net.IP, suffix net.IP, length int) net.IP {
+	mask := net.CIDRMask(length, 8*net.IPv6len)
+	ip, suffix = ip.To16(), suffix.To16()
+	result := make(net.IP, net.IPv6len)
+	for i := range result {
+		result[i] = ip[i]&mask[i] | suffix[i]&^mask[i]
+	}
+	return result
+}
+
+// hostIP returns the IP the host publishes as the given record type, which is
+// the external IP of its uplink. Hosts with an IPv6 suffix publish the suffix
+// within the delegated prefix of the external IPv6 instead, so that all of
+// them move along when the prefix changes.
+func (w *Worker) hostIP(h host.Host, recordType string) net.IP {
+	ip := w.uplink(h).currentIP(recordType)
+	if ip == nil || recordType != host.RecordTypeAAAA || len(h.Suffix) == 0 {
+		return ip
+	}
+	return withSuffix(ip, net.ParseIP(h.Suffix), w.prefixLength())
+}
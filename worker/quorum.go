@@ -0,0 +1,166 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/resolver"
+	"github.com/spf13/viper"
+)
+
+// Quorum decides how many resolvers are asked for the external IP at once, and
+// how many of them must agree on it
+type Quorum struct {
+	Enabled bool
+	Size    int
+	Min     int
+}
+
+func getQuorum() (Quorum, error) {
+	q := Quorum{
+		Enabled: viper.GetBool("resolver.quorum.enabled"),
+		Size:    viper.GetInt("resolver.quorum.size"),
+		Min:     viper.GetInt("resolver.quorum.min"),
+	}
+	if !q.Enabled {
+		return q, nil
+	}
+
+	if q.Min < 1 || q.Min > q.Size {
+		return q, fmt.Errorf("invalid resolver quorum: [%d] out of [%d]", q.Min, q.Size)
+	}
+
+	return q, nil
+}
+
+// quorumResolvers returns the resolvers taking part in the consensus of the
+// given address family. Resolvers not forced to IPv6 vote on the IPv4 address.
+func (w *Worker) quorumResolvers(ipv6 bool) []resolver.Resolver {
+	result := make([]resolver.Resolver, 0)
+	for _, rslv := range w.Resolvers {
+		if rslv.IsIPv6() == ipv6 {
+			result = append(result, rslv)
+		}
+	}
+	return result
+}
+
+// checkQuorum makes sure there are enough resolvers to ever reach the quorum
+func (w *Worker) checkQuorum() error {
+	if !w.Quorum.Enabled {
+		return nil
+	}
+
+	count := len(w.quorumResolvers(false))
+	if count < w.Quorum.Size {
+		return fmt.Errorf("resolver quorum of [%d] requires at least [%d] resolvers, found [%d]", w.Quorum.Min, w.Quorum.Size, count)
+	}
+
+	count = len(w.quorumResolvers(true))
+	if w.needsIPv6() && count > 0 && count < w.Quorum.Min {
+		return fmt.Errorf("resolver quorum of [%d] requires at least [%d] IPv6 resolvers, found [%d]", w.Quorum.Min, w.Quorum.Min, count)
+	}
+
+	return nil
+}
+
+// rounds returns how many checks it takes to go through all resolvers once
+func (w *Worker) rounds() int {
+	if !w.Quorum.Enabled {
+		return len(w.Resolvers)
+	}
+
+	rounds := len(w.quorumResolvers(false)) / w.Quorum.Size
+	if rounds < 1 {
+		rounds = 1
+	}
+	return rounds
+}
+
+// pick returns the given number of resolvers, going round robin from start
+func pick(resolvers []resolver.Resolver, start int, size int) []resolver.Resolver {
+	if size > len(resolvers) {
+		size = len(resolvers)
+	}
+
+	result := make([]resolver.Resolver, 0, size)
+	for i := 0; i < size; i++ {
+		result = append(result, resolvers[(start+i)%len(resolvers)])
+	}
+	return result
+}
+
+// available returns the resolvers that are not cooling down, or all of them
+// when too few are left to ever reach the quorum
+func (w *Worker) available(resolvers []resolver.Resolver) []resolver.Resolver {
+	result := make([]resolver.Resolver, 0, len(resolvers))
+	for _, rslv := range resolvers {
+		if w.isOpen(rslv.Name) {
+			logger.Debug("[WORKER] Resolver [%s] is cooling down, skipping it.", rslv.Name)
+			continue
+		}
+		result = append(result, rslv)
+	}
+	if len(result) < w.Quorum.Min {
+		return resolvers
+	}
+	return result
+}
+
+// getExternalIPQuorum gets the external IP from the next resolvers in line,
+// and the external IPv6 from the IPv6 resolvers when needed. Each address
+// family keeps its current IP when its resolvers do not agree, and only when
+// none of them agree is ErrNoQuorum returned.
+func (w *Worker) getExternalIPQuorum() error {
+	if w.Counter >= w.rounds() {
+		w.Counter = 0
+	}
+	start := w.Counter * w.Quorum.Size
+	w.Counter++
+
+	err := w.resolveQuorum(pick(w.available(w.quorumResolvers(false)), start, w.Quorum.Size))
+
+	resolvers6 := w.quorumResolvers(true)
+	if w.needsIPv6() && len(resolvers6) > 0 {
+		err6 := w.resolveQuorum(pick(w.available(resolvers6), start, w.Quorum.Size))
+		if err == nil || err6 == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// resolveQuorum sets the current IP to the one the resolvers agree on, and
+// keeps track of the resolvers that dissented. Every vote goes through
+// queryResolver, so that it counts towards the health of the resolver and
+// answers failing the validation are rejected.
+func (w *Worker) resolveQuorum(resolvers []resolver.Resolver) error {
+	ip, dissent, err := resolver.Consensus(resolvers, w.Quorum.Min, w.queryResolver)
+	if err != nil {
+		logger.Warn("[WORKER] %s, [%d] of [%d] resolvers must agree: %s", err.Error(), w.Quorum.Min, len(resolvers), describeVotes(dissent))
+		return err
+	}
+
+	if len(dissent) > 0 {
+		if w.Dissents == nil {
+			w.Dissents = make(map[string]int)
+		}
+		for _, v := range dissent {
+			w.Dissents[v.Resolver]++
+		}
+		logger.Warn("[WORKER] Resolvers agreed on [%s], dissented: %s", ip, describeVotes(dissent))
+	}
+
+	w.setCurrentIP(ip)
+	return nil
+}
+
+func describeVotes(votes []resolver.Vote) string {
+	result := make([]string, 0)
+	for _, v := range votes {
+		result = append(result, "["+v.String()+"]")
+	}
+	return strings.Join(result, ", ")
+}
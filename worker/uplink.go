@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kerti/cloudflare-ddns/host"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/resolver"
+)
+
+// initUplinks sets up a worker of its own for every named uplink, keeping
+// track of the external IP its resolvers see. Hosts without an uplink publish
+// the external IP seen by the resolvers of this worker.
+func (w *Worker) initUplinks() error {
+	uplinks, err := resolver.GetUplinks()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	w.Uplinks = make(map[string]*Worker)
+	for _, uplink := range uplinks {
+		u := &Worker{
+			Resolvers:  uplink.Resolvers,
+			Quorum:     w.Quorum,
+			Breaker:    w.Breaker,
+			Validation: w.Validation,
+			Hosts:      make([]host.Host, 0),
+		}
+		for _, h := range w.Hosts {
+			if h.Uplink == uplink.Name {
+				u.Hosts = append(u.Hosts, h)
+			}
+		}
+		err = u.checkQuorum()
+		if err != nil {
+			err = fmt.Errorf("uplink [%s]: %s", uplink.Name, err.Error())
+			logger.Error(err.Error())
+			return err
+		}
+		w.Uplinks[uplink.Name] = u
+	}
+
+	for _, h := range w.Hosts {
+		if len(h.Uplink) > 0 && w.Uplinks[h.Uplink] == nil {
+			err = fmt.Errorf("host [%s] is bound to unknown uplink [%s]", h.Name, h.Uplink)
+			logger.Error(err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uplinkNames returns the names of the uplinks in a stable order
+func (w *Worker) uplinkNames() []string {
+	result := make([]string, 0, len(w.Uplinks))
+	for name := range w.Uplinks {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// uplink returns the worker keeping track of the external IP the host
+// publishes
+func (w *Worker) uplink(h host.Host) *Worker {
+	if u, ok := w.Uplinks[h.Uplink]; ok {
+		return u
+	}
+	return w
+}
+
+// minRounds returns the fewest checks it takes any uplink to go through all of
+// its resolvers once
+func (w *Worker) minRounds() int {
+	result := w.rounds()
+	for _, u := range w.Uplinks {
+		if rounds := u.rounds(); result <= 0 || rounds < result {
+			result = rounds
+		}
+	}
+	return result
+}
+
+// refreshDue tells whether the records are fetched again in this check, which
+// they are once per round of the uplink going through its resolvers fastest
+func (w *Worker) refreshDue() bool {
+	w.checks++
+	if w.checks >= w.minRounds() {
+		w.checks = 0
+		return true
+	}
+	return false
+}
+
+// knowsIP checks whether any external IP is known, on any uplink
+func (w *Worker) knowsIP() bool {
+	if w.CurrentIP != nil || w.CurrentIPv6 != nil {
+		return true
+	}
+	for _, u := range w.Uplinks {
+		if u.CurrentIP != nil || u.CurrentIPv6 != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getUplinkIPs gets the external IP of every uplink from its next resolver in
+// line. An uplink failing to tell its IP keeps the last one known.
+func (w *Worker) getUplinkIPs() {
+	for _, name := range w.uplinkNames() {
+		err := w.Uplinks[name].getExternalIP()
+		if err != nil {
+			logger.Warn("[WORKER] Cannot tell the external IP of uplink [%s], keeping the last one known: %s", name, err.Error())
+		}
+	}
+}
+
+// resolveUplinkIPs gets the initial external IP of every uplink
+func (w *Worker) resolveUplinkIPs() {
+	for _, name := range w.uplinkNames() {
+		logger.Debug("[WORKER] Resolving the external IP of uplink [%s]...", name)
+		w.Uplinks[name].resolveExternalIP()
+	}
+}
+
+// forgetPreviousIPs forgets the previous IPs of all uplinks
+func (w *Worker) forgetPreviousIPs() {
+	w.PreviousIP = nil
+	w.PreviousIPv6 = nil
+	for _, u := range w.Uplinks {
+		u.PreviousIP = nil
+		u.PreviousIPv6 = nil
+	}
+}
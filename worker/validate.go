@@ -0,0 +1,152 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/kerti/cloudflare-ddns/config"
+	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/resolver"
+	"github.com/spf13/viper"
+)
+
+// Validation decides which answers of the resolvers are taken for the external
+// IP. Reserved addresses, such as private, CGNAT or loopback ones, are rejected
+// unless allowed, and so are the denied networks.
+type Validation struct {
+	Enabled bool
+	Allow   []*net.IPNet
+	Deny    []*net.IPNet
+}
+
+func getValidation() (Validation, error) {
+	v := Validation{Enabled: viper.GetBool("resolver.validation.enabled")}
+	if !v.Enabled {
+		logger.Warn("[WORKER] Validation of the external IP is disabled, private and reserved addresses may be published.")
+		return v, nil
+	}
+
+	var err error
+	v.Allow, err = config.Networks(viper.GetStringSlice("resolver.validation.allow"))
+	if err != nil {
+		return v, fmt.Errorf("resolver validation: %s", err.Error())
+	}
+	v.Deny, err = config.Networks(viper.GetStringSlice("resolver.validation.deny"))
+	if err != nil {
+		return v, fmt.Errorf("resolver validation: %s", err.Error())
+	}
+	return v, nil
+}
+
+// reject returns why the IP cannot be the external IP, or an empty string if
+// it can
+func (v Validation) reject(ip net.IP) string {
+	if !v.Enabled || ip == nil {
+		return ""
+	}
+
+	for _, network := range v.Deny {
+		if network.Contains(ip) {
+			return fmt.Sprintf("in the denied network [%s]", network)
+		}
+	}
+	for _, network := range v.Allow {
+		if network.Contains(ip) {
+			return ""
+		}
+	}
+	if kind := resolver.Reserved(ip); len(kind) > 0 {
+		return fmt.Sprintf("a %s address", kind)
+	}
+	return ""
+}
+
+// localAddrs is where checkNAT reads the addresses of the network interfaces
+var localAddrs = resolver.InterfaceAddrs
+
+// checkNAT warns when the addresses of the network interfaces do not line up
+// with the external IPs, which tells there is a carrier-grade or another NAT
+// in between. Hostnames published from behind it are likely unreachable from
+// the internet. It only checks again once the external IPs changed.
+func (w *Worker) checkNAT() {
+	checked := fmt.Sprint(w.externalIPs())
+	if checked == w.natChecked {
+		return
+	}
+	w.natChecked = checked
+
+	addrs, err := localAddrs()
+	if err != nil {
+		logger.Debug("[WORKER] Cannot read the addresses of the network interfaces: %s", err.Error())
+		return
+	}
+
+	for _, warning := range w.natWarnings(addrs) {
+		logger.Warn("[WORKER] Behind CGNAT/double NAT: %s, the hostnames may not be reachable from the internet.", warning)
+	}
+}
+
+// externalIPs returns the external IPs of the worker and its uplinks
+func (w *Worker) externalIPs() []net.IP {
+	result := []net.IP{w.CurrentIP, w.CurrentIPv6}
+	for _, name := range w.uplinkNames() {
+		result = append(result, w.Uplinks[name].CurrentIP, w.Uplinks[name].CurrentIPv6)
+	}
+	return result
+}
+
+// natWarnings tells which of the interface addresses are CGNAT addresses, and
+// which external IPs are none of the public interface addresses of their
+// family, although there are some
+func (w *Worker) natWarnings(addrs map[string][]net.IP) []string {
+	result := make([]string, 0)
+
+	names := make([]string, 0, len(addrs))
+	for name := range addrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	public := make([]net.IP, 0)
+	for _, name := range names {
+		for _, ip := range addrs[name] {
+			if resolver.Reserved(ip) == resolver.ReservedCGNAT {
+				result = append(result, fmt.Sprintf("interface [%s] has the carrier-grade NAT address [%s]", name, ip))
+			}
+			if len(resolver.Reserved(ip)) == 0 {
+				public = append(public, ip)
+			}
+		}
+	}
+
+	// the external IPs of several uplinks do not need to be local
+	if len(w.Uplinks) > 0 {
+		return result
+	}
+
+	for _, ip := range w.externalIPs() {
+		if ip == nil {
+			continue
+		}
+		if resolver.Reserved(ip) == resolver.ReservedCGNAT {
+			result = append(result, fmt.Sprintf("the external IP [%s] is a carrier-grade NAT address", ip))
+			continue
+		}
+
+		sameFamily := make([]string, 0)
+		local := false
+		for _, addr := range public {
+			if (addr.To4() == nil) != (ip.To4() == nil) {
+				continue
+			}
+			sameFamily = append(sameFamily, addr.String())
+			local = local || addr.Equal(ip)
+		}
+		if len(sameFamily) > 0 && !local {
+			result = append(result, fmt.Sprintf("the external IP [%s] is none of the public addresses [%s] of the network interfaces", ip, strings.Join(sameFamily, ", ")))
+		}
+	}
+	return result
+}
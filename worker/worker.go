@@ -4,33 +4,63 @@ import (
 	"math"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	cf "github.com/cloudflare/cloudflare-go"
 	"github.com/kerti/cloudflare-ddns/cloudflare"
+	"github.com/kerti/cloudflare-ddns/host"
 	"github.com/kerti/cloudflare-ddns/logger"
 	"github.com/kerti/cloudflare-ddns/notifier"
+	"github.com/kerti/cloudflare-ddns/provider"
 	"github.com/kerti/cloudflare-ddns/resolver"
+	"github.com/kerti/cloudflare-ddns/rfc2136"
 	"github.com/spf13/viper"
 )
 
 // Worker is the worker class
 type Worker struct {
-	Interval   int
-	Cloudflare cloudflare.Cloudflare
-	Resolvers  []resolver.Resolver
-	Counter    int
-	Hosts      []string
-	HostMap    map[string]cf.DNSRecord
-	CurrentIP  net.IP
+	Interval     int
+	Providers    map[string]provider.Provider
+	Resolvers    []resolver.Resolver
+	Uplinks      map[string]*Worker
+	Quorum       Quorum
+	Dissents     map[string]int
+	Breaker      Breaker
+	Validation   Validation
+	PrefixLength int
+	Health       map[string]*ResolverHealth
+	healthLock   sync.Mutex
+	Counter      int
+	Concurrency  int
+	Hosts        []host.Host
+	HostMap      map[string][]provider.Record
+	fetchFailed  map[string]bool
+	hostMapLock  sync.RWMutex
+	Ownership    Ownership
+	Follow       Follow
+	CurrentIP    net.IP
+	CurrentIPv6  net.IP
+	PreviousIP   net.IP
+	PreviousIPv6 net.IP
+	natChecked   string
+	stateSaved   string
+	checks       int
 }
 
 func (w *Worker) initInterval() {
-	rslvLength := len(w.Resolvers)
+	rslvLength := w.minRounds()
 	if rslvLength <= 0 {
 		rslvLength = 1
 	}
 
+	// a round of resolvers takes 5 minutes, unless none of them minds being
+	// queried often
+	roundInterval := 300
+	if !w.rateLimited() {
+		roundInterval = 30 * rslvLength
+	}
+
 	checkIntervalStr := viper.GetString("worker.checkInterval")
 	checkIntervalInt, err := strconv.Atoi(checkIntervalStr)
 
@@ -40,14 +70,14 @@ func (w *Worker) initInterval() {
 			logger.Warn("Reverting to automatic check interval.")
 		}
 
-		w.Interval = int(math.Round(float64(300) / float64(rslvLength)))
+		w.Interval = int(math.Round(float64(roundInterval) / float64(rslvLength)))
 		logger.Info("Check interval automatically set at %d seconds.", w.Interval)
 	} else {
 		w.Interval = checkIntervalInt
 
 		// prevent invoking a provider more than once per minute
-		if rslvLength*checkIntervalInt < 300 {
-			w.Interval = int(math.Round(float64(300) / float64(rslvLength)))
+		if rslvLength*checkIntervalInt < roundInterval {
+			w.Interval = int(math.Round(float64(roundInterval) / float64(rslvLength)))
 		}
 	}
 
@@ -57,6 +87,25 @@ func (w *Worker) initInterval() {
 	}
 }
 
+// rateLimited checks whether any of the resolvers should not be queried often
+func (w *Worker) rateLimited() bool {
+	if len(w.Resolvers) == 0 {
+		return true
+	}
+
+	for _, rslv := range w.Resolvers {
+		if rslv.IsRateLimited() {
+			return true
+		}
+	}
+	for _, u := range w.Uplinks {
+		if u.rateLimited() {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *Worker) initProperties() error {
 	// initialize the resolvers
 	resolvers, err := resolver.Get()
@@ -69,38 +118,155 @@ func (w *Worker) initProperties() error {
 	// initialize counter
 	w.Counter = 0
 
-	// initialize the interval
-	w.initInterval()
+	// initialize the circuit breaker of failing resolvers
+	w.Breaker = getBreaker()
+
+	// initialize the validation of the external IP
+	validation, err := getValidation()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	w.Validation = validation
+
+	// initialize the length of the delegated IPv6 prefix
+	prefixLength, err := getPrefixLength()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	w.PrefixLength = prefixLength
+
+	// initialize the resolver quorum, before the interval depending on it
+	quorum, err := getQuorum()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	w.Quorum = quorum
+
+	// initialize the number of hosts checked at once
+	w.Concurrency = getConcurrency()
 
 	// initialize hosts
-	w.Hosts = viper.GetStringSlice("cloudflare.hostnames")
+	hosts, err := host.Get()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	w.Hosts = hosts
 
-	// initialize cloudflare client
-	cfClient, err := cloudflare.New()
+	// make sure the quorum can be reached for the hosts
+	err = w.checkQuorum()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	// initialize the uplinks the hosts may be bound to
+	err = w.initUplinks()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	// initialize the interval, once the resolvers of all uplinks are known
+	w.initInterval()
+
+	// initialize ownership
+	ownership, err := getOwnership()
 	if err != nil {
 		logger.Error(err.Error())
 		return err
 	}
-	w.Cloudflare = *cfClient
+	err = ownership.prepareHosts(w.Hosts)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	w.Ownership = ownership
+
+	// initialize following the external IP
+	follow, err := getFollow()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	w.Follow = follow
+
+	// initialize providers
+	err = w.initProviders()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (w *Worker) initProviders() error {
+	w.Providers = make(map[string]provider.Provider)
+
+	// initialize cloudflare client
+	cfHosts := host.Filter(w.Hosts, host.ProviderCloudflare)
+	listHosts := host.Filter(w.Hosts, host.ProviderCloudflareIPList)
+	if len(cfHosts) > 0 || len(listHosts) > 0 || w.Follow.Enabled {
+		cfClient, err := cloudflare.New(append(cfHosts, w.Ownership.markerHosts(cfHosts)...))
+		if err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+
+		// make sure the credentials can actually manage the records
+		err = cfClient.Verify()
+		if err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+		w.Providers[host.ProviderCloudflare] = cfClient
+
+		// the IP List shares the client, and therefore its retries and rate limit
+		if len(listHosts) > 0 {
+			ipList := cfClient.IPList(viper.GetString("cloudflare.ipList.accountID"), viper.GetString("cloudflare.ipList.listID"))
+			err = ipList.Verify()
+			if err != nil {
+				logger.Error(err.Error())
+				return err
+			}
+			w.Providers[host.ProviderCloudflareIPList] = ipList
+		}
+	}
+
+	// initialize RFC 2136 client
+	rfcHosts := host.Filter(w.Hosts, host.ProviderRFC2136)
+	if len(rfcHosts) > 0 {
+		rfcClient, err := rfc2136.New(append(rfcHosts, w.Ownership.markerHosts(rfcHosts)...))
+		if err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+		w.Providers[host.ProviderRFC2136] = rfcClient
+	}
 
 	return nil
 }
 
 func (w *Worker) initExternal() error {
+	report := newReport()
+	defer report.log()
+
 	// initialize hostmap
-	w.getDNSRecords()
+	w.getDNSRecords(report)
 
 	// get current IP
-	rslv := w.Resolvers[len(w.Resolvers)-1]
-	currentIP, err := rslv.GetExternalIP()
-	if err != nil {
-		logger.Error(err.Error())
-	}
-	w.CurrentIP = currentIP
+	w.resolveExternalIP()
+	w.resolveUplinkIPs()
+	w.restorePreviousIPs()
+	w.checkNAT()
 
 	// run first check on host list
-	if w.CurrentIP != nil {
-		err = w.checkHosts()
+	if w.knowsIP() {
+		err := w.checkHosts(report)
 		if err != nil {
 			logger.Error(err.Error())
 			return err
@@ -110,6 +276,42 @@ func (w *Worker) initExternal() error {
 	return nil
 }
 
+// resolveExternalIP gets the initial external IP from the last resolver, and
+// the external IPv6 from the last IPv6 resolver when still needed
+func (w *Worker) resolveExternalIP() {
+	if len(w.Resolvers) == 0 {
+		logger.Warn("[WORKER] No resolvers configured, external IP unknown.")
+		return
+	}
+
+	if w.Quorum.Enabled {
+		w.getExternalIPQuorum()
+		return
+	}
+
+	rslv := w.Resolvers[len(w.Resolvers)-1]
+	currentIP, err := w.queryResolver(rslv)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	w.setCurrentIP(currentIP)
+
+	// get current IPv6 if a dedicated resolver is available and still needed
+	if w.CurrentIPv6 == nil && w.needsIPv6() {
+		for i := len(w.Resolvers) - 1; i >= 0; i-- {
+			if !w.Resolvers[i].IsIPv6() {
+				continue
+			}
+			currentIP, err = w.queryResolver(w.Resolvers[i])
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			w.setCurrentIP(currentIP)
+			break
+		}
+	}
+}
+
 func (w *Worker) init() error {
 	// initialize properties
 	err := w.initProperties()
@@ -130,6 +332,27 @@ func (w *Worker) init() error {
 	return nil
 }
 
+// Plan resolves the external IP and fetches the current records like Run does,
+// and returns the changes the worker would make without applying any of them
+func (w *Worker) Plan() ([]Change, error) {
+	err := w.initProperties()
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	report := newReport()
+	defer report.log()
+	w.getDNSRecords(report)
+	w.resolveExternalIP()
+	w.resolveUplinkIPs()
+	w.restorePreviousIPs()
+
+	changes := w.plan()
+	followChanges, _ := w.planFollow(report)
+	return append(changes, followChanges...), nil
+}
+
 // Run runs the worker
 func (w *Worker) Run() error {
 	err := w.init()
@@ -150,16 +373,29 @@ func (w *Worker) Run() error {
 }
 
 func (w *Worker) check() error {
-	err := w.getExternalIP()
-	if err != nil {
-		logger.Error(err.Error())
+	w.getUplinkIPs()
+
+	// with uplinks alone, there is no external IP of the worker itself
+	if len(w.Resolvers) > 0 {
+		err := w.getExternalIP()
+		if err == resolver.ErrNoQuorum {
+			logger.Warn("[WORKER] External IP is uncertain, skipping this check.")
+			return nil
+		}
+		if err != nil {
+			logger.Error(err.Error())
+		}
 	}
+	w.checkNAT()
 
-	if w.Counter == len(w.Resolvers)-1 {
-		w.getDNSRecords()
+	report := newReport()
+	if w.refreshDue() {
+		w.getDNSRecords(report)
 	}
 
-	err = w.checkHosts()
+	err := w.checkHosts(report)
+	report.log()
+	w.logStats()
 	if err != nil {
 		logger.Error(err.Error())
 		return err
@@ -168,86 +404,179 @@ func (w *Worker) check() error {
 	return nil
 }
 
-func (w *Worker) getExternalIP() error {
-	if w.Counter >= len(w.Resolvers) {
-		w.Counter = 0
+// logStats logs the API call statistics of the providers keeping them, how
+// often each resolver dissented from the quorum, and the health of resolvers
+func (w *Worker) logStats() {
+	for name, p := range w.Providers {
+		if reporter, ok := p.(provider.StatsReporter); ok {
+			stats := reporter.Stats()
+			logger.Debug("[WORKER] Provider [%s] API calls retried: %d, abandoned: %d", name, stats.Retried, stats.Abandoned)
+		}
 	}
 
-	rslv := w.Resolvers[w.Counter]
-	externalIP, err := rslv.GetExternalIP()
-	w.Counter++
+	w.logHealth("")
+	for _, name := range w.uplinkNames() {
+		w.Uplinks[name].logHealth(name + "/")
+	}
+}
 
+func (w *Worker) getExternalIP() error {
+	if w.Quorum.Enabled {
+		return w.getExternalIPQuorum()
+	}
+
+	err := w.getExternalIPRoundRobin()
 	if err != nil {
 		logger.Error(err.Error())
 		return err
 	}
 
-	w.CurrentIP = externalIP
 	return nil
 }
 
-func (w *Worker) getDNSRecords() {
-	w.HostMap = make(map[string]cf.DNSRecord)
-	for _, host := range w.Hosts {
-		hostmap, err := w.Cloudflare.FetchA(host)
-		if err != nil {
-			logger.Error(err.Error())
-			continue
+func (w *Worker) setCurrentIP(ip net.IP) {
+	if ip == nil {
+		return
+	}
+
+	// remember the previous IP until the records following it are updated
+	if ip.To4() != nil {
+		if w.CurrentIP != nil && !w.CurrentIP.Equal(ip) {
+			w.PreviousIP = w.CurrentIP
 		}
-		for k, v := range hostmap {
-			w.HostMap[k] = v
+		w.CurrentIP = ip
+	} else {
+		if w.CurrentIPv6 != nil && !w.CurrentIPv6.Equal(ip) {
+			w.PreviousIPv6 = w.CurrentIPv6
 		}
+		w.CurrentIPv6 = ip
 	}
 }
 
-func (w *Worker) checkHosts() error {
-	for _, host := range w.Hosts {
-		rec, ok := w.HostMap[host]
+func (w *Worker) currentIP(recordType string) net.IP {
+	if recordType == host.RecordTypeAAAA {
+		return w.CurrentIPv6
+	}
+	return w.CurrentIP
+}
 
-		if !ok {
-			logger.Debug("[WORKER] Host [%s] not found, adding...", host)
-			res, err := w.Cloudflare.CreateA(host, w.CurrentIP)
-			if err != nil {
-				logger.Error(err.Error())
-				continue
-			}
-			w.HostMap[host] = res
-			continue
+func (w *Worker) needsIPv6() bool {
+	for _, h := range w.Hosts {
+		if h.Family != host.FamilyIPv4 {
+			return true
 		}
+	}
+	return false
+}
 
-		parsedContent := net.ParseIP(rec.Content)
-		if parsedContent == nil || parsedContent.String() != w.CurrentIP.String() {
-			logger.Debug("[WORKER] Host [%s] has different IP address, setting...", host)
-			err := w.Cloudflare.UpdateA(rec.ID, host, w.CurrentIP)
-			if err != nil {
-				logger.Error(err.Error())
-				continue
-			}
+// recordKey returns the key of the records of a host in the HostMap. The same
+// hostname may be published by several providers, such as for split-horizon.
+func recordKey(providerName string, name string, recordType string) string {
+	return providerName + "/" + recordType + "/" + name
+}
 
-			go w.setIP(host, w.CurrentIP)
-			go w.notify(host, parsedContent.String(), w.CurrentIP.String())
-			continue
-		}
+// records returns the known records of a host and record type
+func (w *Worker) records(key string) []provider.Record {
+	w.hostMapLock.RLock()
+	defer w.hostMapLock.RUnlock()
+	return w.HostMap[key]
+}
+
+func (w *Worker) setRecords(key string, records []provider.Record) {
+	w.hostMapLock.Lock()
+	defer w.hostMapLock.Unlock()
+	w.HostMap[key] = records
+}
 
-		logger.Debug("[WORKER] Host [%s] has correct IP address set, skipping...", host)
+// unreadable returns the key of the first record set of the host, including
+// its companion record, that could not be fetched, if any
+func (w *Worker) unreadable(h host.Host) (string, bool) {
+	keys := make([]string, 0)
+	for _, recordType := range h.RecordTypes() {
+		keys = append(keys, recordKey(h.Provider, h.Name, recordType))
+	}
+	if w.Ownership.Mode == OwnershipTXT && w.Ownership.applies(h) {
+		keys = append(keys, recordKey(h.Provider, markerPrefix+h.Name, "TXT"))
 	}
 
-	return nil
+	w.hostMapLock.RLock()
+	defer w.hostMapLock.RUnlock()
+	for _, key := range keys {
+		if w.fetchFailed[key] {
+			return key, true
+		}
+	}
+	return "", false
 }
 
-func (w *Worker) setIP(host string, newIP net.IP) {
-	rec, ok := w.HostMap[host]
-	if !ok {
-		w.getDNSRecords()
+// getDNSRecords fetches the records of all hosts on the worker pool
+func (w *Worker) getDNSRecords(report *Report) {
+	w.hostMapLock.Lock()
+	w.HostMap = make(map[string][]provider.Record)
+	w.fetchFailed = make(map[string]bool)
+	w.hostMapLock.Unlock()
+
+	jobs := make([]func(), 0)
+	for _, h := range w.Hosts {
+		for _, recordType := range h.RecordTypes() {
+			jobs = append(jobs, w.fetchJob(h, recordType, report))
+		}
+	}
+	for _, h := range w.Ownership.markerHosts(w.Hosts) {
+		jobs = append(jobs, w.fetchJob(h, "TXT", report))
+	}
+
+	runPool(w.Concurrency, jobs)
+}
 
-		rec, ok = w.HostMap[host]
-		if !ok {
+func (w *Worker) fetchJob(h host.Host, recordType string, report *Report) func() {
+	return func() {
+		records, err := w.Providers[h.Provider].Fetch(h, recordType)
+		if err != nil {
+			report.failed("failed to fetch %s records of host [%s]: %s", recordType, h.Name, err.Error())
+			w.hostMapLock.Lock()
+			w.fetchFailed[recordKey(h.Provider, h.Name, recordType)] = true
+			w.hostMapLock.Unlock()
 			return
 		}
+		report.fetched(len(records))
+		w.setRecords(recordKey(h.Provider, h.Name, recordType), records)
 	}
+}
 
-	rec.Content = newIP.String()
-	w.HostMap[host] = rec
+// checkHosts applies the changes of every host on the worker pool. The changes
+// of a single host are applied in order by the same job.
+func (w *Worker) checkHosts(report *Report) error {
+	hostChanges := w.planHosts()
+	jobs := make([]func(), 0)
+	for _, changes := range hostChanges {
+		if len(changes) == 0 {
+			continue
+		}
+		changes := changes
+		jobs = append(jobs, func() { w.apply(changes, report) })
+	}
+
+	// followed records are not tied to each other, so each gets its own job
+	followChanges, complete := w.planFollow(report)
+	var followFailed int32
+	for _, change := range followChanges {
+		changes := []Change{change}
+		jobs = append(jobs, func() {
+			if !w.apply(changes, report) {
+				atomic.StoreInt32(&followFailed, 1)
+			}
+		})
+	}
+
+	runPool(w.Concurrency, jobs)
+
+	// forget the previous IP once nothing follows it anymore
+	if complete && atomic.LoadInt32(&followFailed) == 0 {
+		w.forgetPreviousIPs()
+		w.savePublishedIPs()
+	}
+	return nil
 }
 
 func (w *Worker) notify(host string, oldIP string, newIP string) {
@@ -1,10 +1,24 @@
 package worker
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/kerti/cloudflare-ddns/config"
+	"github.com/kerti/cloudflare-ddns/host"
 	"github.com/kerti/cloudflare-ddns/logger"
+	"github.com/kerti/cloudflare-ddns/provider"
 	"github.com/kerti/cloudflare-ddns/resolver"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -124,6 +138,387 @@ var (
 	}
 )
 
+var (
+	enabled  = true
+	disabled = false
+
+	attributesChangedTestCases = []struct {
+		name    string
+		host    host.Host
+		proxied bool
+		ttl     int
+		comment string
+		result  bool
+	}{
+		{
+			name:    "nothingConfigured",
+			host:    host.Host{Name: "example.com"},
+			proxied: true,
+			ttl:     300,
+			comment: "something",
+			result:  false,
+		},
+		{
+			name:    "proxiedMatches",
+			host:    host.Host{Name: "example.com", Proxied: &enabled},
+			proxied: true,
+			ttl:     1,
+			result:  false,
+		},
+		{
+			name:    "proxiedDiffers",
+			host:    host.Host{Name: "example.com", Proxied: &disabled},
+			proxied: true,
+			ttl:     1,
+			result:  true,
+		},
+		{
+			name:   "ttlMatches",
+			host:   host.Host{Name: "example.com", TTL: 300},
+			ttl:    300,
+			result: false,
+		},
+		{
+			name:   "ttlDiffers",
+			host:   host.Host{Name: "example.com", TTL: 300},
+			ttl:    1,
+			result: true,
+		},
+		{
+			name:    "ttlIgnoredWhenProxied",
+			host:    host.Host{Name: "example.com", TTL: 300},
+			proxied: true,
+			ttl:     1,
+			result:  false,
+		},
+		{
+			name:    "ttlDiffersWhenUnproxying",
+			host:    host.Host{Name: "example.com", TTL: 300, Proxied: &disabled},
+			proxied: false,
+			ttl:     1,
+			result:  true,
+		},
+		{
+			name:    "commentDiffers",
+			host:    host.Host{Name: "example.com", Comment: "managed"},
+			comment: "",
+			result:  true,
+		},
+	}
+)
+
+var (
+	policyTestCases = []struct {
+		name     string
+		policy   string
+		existing []string
+		result   []string
+		created  int
+		updated  int
+		deleted  int
+	}{
+		{
+			name:    "singleMissing",
+			policy:  host.PolicySingle,
+			result:  []string{"1.2.3.4"},
+			created: 1,
+		},
+		{
+			name:     "singleUpToDate",
+			policy:   host.PolicySingle,
+			existing: []string{"1.2.3.4"},
+			result:   []string{"1.2.3.4"},
+		},
+		{
+			name:     "singleChanged",
+			policy:   host.PolicySingle,
+			existing: []string{"5.6.7.8"},
+			result:   []string{"1.2.3.4"},
+			updated:  1,
+		},
+		{
+			name:     "singleDuplicates",
+			policy:   host.PolicySingle,
+			existing: []string{"5.6.7.8", "1.2.3.4", "9.9.9.9"},
+			result:   []string{"1.2.3.4"},
+			deleted:  2,
+		},
+		{
+			name:     "singleStaleDuplicates",
+			policy:   host.PolicySingle,
+			existing: []string{"5.6.7.8", "9.9.9.9"},
+			result:   []string{"1.2.3.4"},
+			updated:  1,
+			deleted:  1,
+		},
+		{
+			name:     "ensurePresentMissing",
+			policy:   host.PolicyEnsurePresent,
+			existing: []string{"5.6.7.8"},
+			result:   []string{"5.6.7.8", "1.2.3.4"},
+			created:  1,
+		},
+		{
+			name:     "ensurePresentPresent",
+			policy:   host.PolicyEnsurePresent,
+			existing: []string{"5.6.7.8", "1.2.3.4"},
+			result:   []string{"5.6.7.8", "1.2.3.4"},
+		},
+		{
+			name:     "replaceAllMissing",
+			policy:   host.PolicyReplaceAll,
+			existing: []string{"5.6.7.8", "9.9.9.9"},
+			result:   []string{"1.2.3.4"},
+			created:  1,
+			deleted:  2,
+		},
+		{
+			name:     "replaceAllPresent",
+			policy:   host.PolicyReplaceAll,
+			existing: []string{"5.6.7.8", "1.2.3.4"},
+			result:   []string{"1.2.3.4"},
+			deleted:  1,
+		},
+	}
+)
+
+var (
+	testMarker = "heritage=cloudflare-ddns,instance=router-1"
+
+	ownershipTestCases = []struct {
+		name     string
+		mode     string
+		adopt    bool
+		existing []provider.Record
+		result   []string
+		refused  int
+	}{
+		{
+			name:     "offOverwrites",
+			mode:     OwnershipOff,
+			existing: []provider.Record{{Content: "5.6.7.8"}},
+			result:   []string{"A home.example.com 1.2.3.4 "},
+		},
+		{
+			name:   "commentCreate",
+			mode:   OwnershipComment,
+			result: []string{"A home.example.com 1.2.3.4 " + testMarker},
+		},
+		{
+			name:     "commentUnowned",
+			mode:     OwnershipComment,
+			existing: []provider.Record{{Content: "5.6.7.8", Comment: "production"}},
+			result:   []string{"A home.example.com 5.6.7.8 production"},
+			refused:  1,
+		},
+		{
+			name:     "commentOwned",
+			mode:     OwnershipComment,
+			existing: []provider.Record{{Content: "5.6.7.8", Comment: testMarker}},
+			result:   []string{"A home.example.com 1.2.3.4 " + testMarker},
+		},
+		{
+			name:     "commentOtherInstance",
+			mode:     OwnershipComment,
+			existing: []provider.Record{{Content: "5.6.7.8", Comment: testMarker + "0"}},
+			result:   []string{"A home.example.com 5.6.7.8 " + testMarker + "0"},
+			refused:  1,
+		},
+		{
+			name:     "commentAdopt",
+			mode:     OwnershipComment,
+			adopt:    true,
+			existing: []provider.Record{{Content: "1.2.3.4"}},
+			result:   []string{"A home.example.com 1.2.3.4 " + testMarker},
+		},
+		{
+			name: "txtCreate",
+			mode: OwnershipTXT,
+			result: []string{
+				"TXT _cfddns.home.example.com " + testMarker + " ",
+				"A home.example.com 1.2.3.4 ",
+			},
+		},
+		{
+			name:     "txtUnowned",
+			mode:     OwnershipTXT,
+			existing: []provider.Record{{Content: "5.6.7.8"}},
+			result:   []string{"A home.example.com 5.6.7.8 "},
+			refused:  1,
+		},
+		{
+			name: "txtOwned",
+			mode: OwnershipTXT,
+			existing: []provider.Record{
+				{Content: "5.6.7.8"},
+				{Type: "TXT", Name: "_cfddns.home.example.com", Content: `"` + testMarker + `"`},
+			},
+			result: []string{
+				"A home.example.com 1.2.3.4 ",
+				"TXT _cfddns.home.example.com \"" + testMarker + "\" ",
+			},
+		},
+		{
+			name: "txtOtherInstance",
+			mode: OwnershipTXT,
+			existing: []provider.Record{
+				{Content: "5.6.7.8"},
+				{Type: "TXT", Name: "_cfddns.home.example.com", Content: `"` + testMarker + `0"`},
+			},
+			result: []string{
+				"A home.example.com 5.6.7.8 ",
+				"TXT _cfddns.home.example.com \"" + testMarker + "0\" ",
+			},
+			refused: 1,
+		},
+		{
+			name:     "txtAdopt",
+			mode:     OwnershipTXT,
+			adopt:    true,
+			existing: []provider.Record{{Content: "1.2.3.4"}},
+			result: []string{
+				"A home.example.com 1.2.3.4 ",
+				"TXT _cfddns.home.example.com " + testMarker + " ",
+			},
+		},
+	}
+)
+
+// fakeProvider keeps records in memory
+type fakeProvider struct {
+	lock    sync.Mutex
+	records []provider.Record
+	failing map[string]bool
+	refuse  map[string]bool
+	nextID  int
+	created int
+	updated int
+	deleted int
+}
+
+// staticResolver returns a resolver always answering with the given body
+func staticResolver(name string, body string) resolver.Resolver {
+	return resolver.Resolver{
+		Name: name,
+		Type: "text",
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+		})},
+	}
+}
+
+// flakyResolver answers with the body while up is set, and fails otherwise
+func flakyResolver(name string, body string, up *int32) resolver.Resolver {
+	return resolver.Resolver{
+		Name: name,
+		Type: "text",
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			status := http.StatusOK
+			if atomic.LoadInt32(up) == 0 {
+				status = http.StatusServiceUnavailable
+			}
+			return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+		})},
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (p *fakeProvider) add(rec provider.Record) provider.Record {
+	p.nextID++
+	rec.ID = strconv.Itoa(p.nextID)
+	if len(rec.Name) == 0 {
+		rec.Name = "home.example.com"
+	}
+	if len(rec.Type) == 0 {
+		rec.Type = host.RecordTypeA
+	}
+	p.records = append(p.records, rec)
+	return rec
+}
+
+func (p *fakeProvider) contents() []string {
+	result := make([]string, 0)
+	for _, rec := range p.records {
+		result = append(result, rec.Content)
+	}
+	return result
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) Fetch(h host.Host, recordType string) ([]provider.Record, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.failing[h.Name] {
+		return nil, fmt.Errorf("cannot fetch records of [%s]", h.Name)
+	}
+	result := make([]provider.Record, 0)
+	for _, rec := range p.records {
+		if rec.Name == h.Name && rec.Type == recordType {
+			result = append(result, rec)
+		}
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) Search(zone string, recordType string, content string) ([]provider.Record, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	result := make([]provider.Record, 0)
+	for _, rec := range p.records {
+		if rec.Type == recordType && rec.Content == content {
+			result = append(result, rec)
+		}
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) Create(h host.Host, recordType string, content string) (provider.Record, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.refuse[h.Name] {
+		return provider.Record{}, fmt.Errorf("cannot create records of [%s]", h.Name)
+	}
+	p.created++
+	return p.add(provider.Record{Type: recordType, Name: h.Name, Content: content, Comment: h.Comment}), nil
+}
+
+func (p *fakeProvider) Update(rec provider.Record, h host.Host, content string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.updated++
+	for i := range p.records {
+		if p.records[i].ID == rec.ID {
+			p.records[i].Content = content
+			if len(h.Comment) > 0 {
+				p.records[i].Comment = h.Comment
+			}
+		}
+	}
+	return nil
+}
+
+func (p *fakeProvider) Delete(rec provider.Record) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.deleted++
+	records := make([]provider.Record, 0)
+	for _, existing := range p.records {
+		if existing.ID != rec.ID {
+			records = append(records, existing)
+		}
+	}
+	p.records = records
+	return nil
+}
+
 func TestWorker(t *testing.T) {
 
 	logger.InitLogger(&initloglevel)
@@ -143,5 +538,816 @@ func TestWorker(t *testing.T) {
 			})
 		}
 
+		// STUN resolvers only leave the minimum interval in place
+		viper.Set("worker.checkInterval", "auto")
+		worker.Resolvers = []resolver.Resolver{{Type: "stun"}, {Type: "stun"}}
+		worker.initInterval()
+		assert.Equal(t, 30, worker.Interval)
+
+		viper.Set("worker.checkInterval", "45")
+		worker.initInterval()
+		assert.Equal(t, 45, worker.Interval)
+
+		worker.Resolvers = append(worker.Resolvers, resolver.Resolver{Type: "text"})
+		worker.initInterval()
+		assert.Equal(t, 100, worker.Interval)
+		viper.Set("worker.checkInterval", "auto")
+
+	})
+	t.Run("setCurrentIP", func(t *testing.T) {
+		worker := Worker{}
+		worker.setCurrentIP(net.ParseIP("1.2.3.4"))
+		worker.setCurrentIP(net.ParseIP("2001:db8::1"))
+		worker.setCurrentIP(nil)
+		assert.Equal(t, net.ParseIP("1.2.3.4"), worker.currentIP(host.RecordTypeA))
+		assert.Equal(t, net.ParseIP("2001:db8::1"), worker.currentIP(host.RecordTypeAAAA))
+	})
+
+	t.Run("needsIPv6", func(t *testing.T) {
+		worker := Worker{Hosts: []host.Host{{Name: "a.example.com", Family: host.FamilyIPv4}}}
+		assert.False(t, worker.needsIPv6())
+		worker.Hosts = append(worker.Hosts, host.Host{Name: "b.example.com", Family: host.FamilyDual})
+		assert.True(t, worker.needsIPv6())
+	})
+	t.Run("attributesChanged", func(t *testing.T) {
+		for _, tc := range attributesChangedTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				rec := provider.Record{Proxied: tc.proxied, TTL: tc.ttl, Comment: tc.comment}
+				assert.Equal(t, tc.result, attributesChanged(tc.host, rec))
+			})
+		}
+	})
+
+	t.Run("checkHost", func(t *testing.T) {
+		for _, tc := range policyTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				fake := &fakeProvider{}
+				for _, content := range tc.existing {
+					fake.add(provider.Record{Content: content})
+				}
+
+				h := host.Host{Name: "home.example.com", Provider: "fake", Family: host.FamilyIPv4, Policy: tc.policy}
+				worker := Worker{
+					Providers: map[string]provider.Provider{"fake": fake},
+					Hosts:     []host.Host{h},
+					CurrentIP: net.ParseIP("1.2.3.4"),
+				}
+				worker.getDNSRecords(newReport())
+				worker.checkHosts(newReport())
+
+				assert.Equal(t, tc.result, fake.contents())
+				assert.Equal(t, fake.records, worker.HostMap[recordKey(h.Provider, h.Name, host.RecordTypeA)])
+				assert.Equal(t, tc.created, fake.created)
+				assert.Equal(t, tc.updated, fake.updated)
+				assert.Equal(t, tc.deleted, fake.deleted)
+			})
+		}
+	})
+
+	t.Run("splitHorizon", func(t *testing.T) {
+		public := &fakeProvider{}
+		public.add(provider.Record{Content: "5.6.7.8"})
+		internal := &fakeProvider{}
+		internal.add(provider.Record{Content: "1.2.3.4"})
+
+		worker := Worker{
+			Providers: map[string]provider.Provider{"public": public, "internal": internal},
+			Hosts: []host.Host{
+				{Name: "home.example.com", Provider: "public", Family: host.FamilyIPv4, Policy: host.PolicySingle},
+				{Name: "home.example.com", Provider: "internal", Family: host.FamilyIPv4, Policy: host.PolicySingle},
+			},
+			CurrentIP: net.ParseIP("1.2.3.4"),
+		}
+		worker.getDNSRecords(newReport())
+		assert.Equal(t, public.records, worker.HostMap[recordKey("public", "home.example.com", host.RecordTypeA)])
+		assert.Equal(t, internal.records, worker.HostMap[recordKey("internal", "home.example.com", host.RecordTypeA)])
+
+		worker.checkHosts(newReport())
+		assert.Equal(t, []string{"1.2.3.4"}, public.contents())
+		assert.Equal(t, 1, public.updated)
+		assert.Equal(t, []string{"1.2.3.4"}, internal.contents())
+		assert.Equal(t, 0, internal.created+internal.updated+internal.deleted)
+	})
+
+	t.Run("plan", func(t *testing.T) {
+		fake := &fakeProvider{}
+		fake.add(provider.Record{Content: "5.6.7.8"})
+		fake.add(provider.Record{Content: "9.9.9.9"})
+
+		h := host.Host{Name: "home.example.com", Provider: "fake", Family: host.FamilyIPv4, Policy: host.PolicySingle, Proxied: &enabled, TTL: 300}
+		worker := Worker{
+			Providers: map[string]provider.Provider{"fake": fake},
+			Hosts:     []host.Host{h},
+			CurrentIP: net.ParseIP("1.2.3.4"),
+		}
+		worker.getDNSRecords(newReport())
+		changes := worker.plan()
+
+		assert.Equal(t, 0, fake.updated+fake.deleted+fake.created)
+		assert.Len(t, changes, 2)
+		assert.Equal(t, ActionUpdate, changes[0].Action)
+		assert.Equal(t, "5.6.7.8", changes[0].OldContent)
+		assert.Equal(t, "1.2.3.4", changes[0].NewContent)
+		assert.Equal(t, &BoolChange{Old: false, New: true}, changes[0].Proxied)
+		assert.Nil(t, changes[0].TTL)
+		assert.Equal(t, ActionDelete, changes[1].Action)
+		assert.Equal(t, "9.9.9.9", changes[1].OldContent)
+
+		out := new(bytes.Buffer)
+		err := WritePlan(out, changes, PlanFormatText)
+		assert.Nil(t, err)
+		assert.Equal(t, "~  A  home.example.com  5.6.7.8 -> 1.2.3.4  proxied: false -> true\n"+
+			"-  A  home.example.com  9.9.9.9\n"+
+			"\nPlan: 0 to create, 1 to update, 1 to delete.\n", out.String())
+
+		out.Reset()
+		err = WritePlan(out, changes[1:], PlanFormatJSON)
+		assert.Nil(t, err)
+		assert.JSONEq(t, `[{"action": "delete", "host": "home.example.com", "provider": "fake", "type": "A", "oldContent": "9.9.9.9"}]`, out.String())
+
+		out.Reset()
+		err = WritePlan(out, nil, PlanFormatText)
+		assert.Nil(t, err)
+		assert.Equal(t, "No changes, all records are up to date.\n", out.String())
+
+		err = WritePlan(out, changes, "yaml")
+		assert.NotNil(t, err)
+		assert.Equal(t, "unsupported plan format: [yaml]", err.Error())
+	})
+
+	t.Run("ownership", func(t *testing.T) {
+		for _, tc := range ownershipTestCases {
+			t.Run(tc.name, func(t *testing.T) {
+				fake := &fakeProvider{}
+				for _, rec := range tc.existing {
+					fake.add(rec)
+				}
+
+				hosts := []host.Host{{Name: "home.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyIPv4, Policy: host.PolicySingle, Adopt: tc.adopt}}
+				worker := Worker{
+					Providers: map[string]provider.Provider{host.ProviderCloudflare: fake},
+					Hosts:     hosts,
+					Ownership: Ownership{Mode: tc.mode, InstanceID: "router-1"},
+					CurrentIP: net.ParseIP("1.2.3.4"),
+				}
+				err := worker.Ownership.prepareHosts(worker.Hosts)
+				assert.Nil(t, err)
+				worker.getDNSRecords(newReport())
+
+				refused := 0
+				for _, change := range worker.plan() {
+					if len(change.Refused) > 0 {
+						refused++
+					}
+				}
+				assert.Equal(t, tc.refused, refused)
+
+				worker.checkHosts(newReport())
+				result := make([]string, 0)
+				for _, rec := range fake.records {
+					result = append(result, rec.Type+" "+rec.Name+" "+rec.Content+" "+rec.Comment)
+				}
+				assert.Equal(t, tc.result, result)
+			})
+		}
+
+		// hosts whose records or companion record cannot be fetched are left alone
+		for _, failing := range []string{"home.example.com", "_cfddns.home.example.com"} {
+			fake := &fakeProvider{failing: map[string]bool{failing: true}}
+			fake.add(provider.Record{Content: "5.6.7.8"})
+			worker := Worker{
+				Providers: map[string]provider.Provider{host.ProviderCloudflare: fake},
+				Hosts:     []host.Host{{Name: "home.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyIPv4, Policy: host.PolicySingle}},
+				Ownership: Ownership{Mode: OwnershipTXT, InstanceID: "router-1"},
+				CurrentIP: net.ParseIP("1.2.3.4"),
+			}
+			report := newReport()
+			worker.getDNSRecords(report)
+			assert.Len(t, report.Errors, 1)
+			assert.Empty(t, worker.plan())
+			assert.Nil(t, worker.checkHosts(report))
+			assert.Equal(t, []string{"5.6.7.8"}, fake.contents())
+		}
+
+		// no records are created when their companion record cannot be
+		fake := &fakeProvider{refuse: map[string]bool{"_cfddns.home.example.com": true}}
+		worker := Worker{
+			Providers: map[string]provider.Provider{host.ProviderCloudflare: fake},
+			Hosts:     []host.Host{{Name: "home.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyIPv4, Policy: host.PolicySingle}},
+			Ownership: Ownership{Mode: OwnershipTXT, InstanceID: "router-1"},
+			CurrentIP: net.ParseIP("1.2.3.4"),
+		}
+		report := newReport()
+		worker.getDNSRecords(report)
+		worker.checkHosts(report)
+		assert.Len(t, report.Errors, 2)
+		assert.Equal(t, 1, report.Skipped)
+		assert.Empty(t, fake.records)
+
+		viper.Set("ownership.mode", "owner")
+		_, err := getOwnership()
+		assert.NotNil(t, err)
+		assert.Equal(t, "unsupported ownership mode: [owner]", err.Error())
+		viper.Set("ownership.mode", OwnershipOff)
+
+		err = Ownership{Mode: OwnershipComment}.prepareHosts([]host.Host{{Name: "home.example.org", Provider: host.ProviderRFC2136}})
+		assert.NotNil(t, err)
+		assert.Equal(t, "ownership mode [comment] is not supported for host [home.example.org] of provider [rfc2136], use [txt]", err.Error())
+	})
+
+	t.Run("pool", func(t *testing.T) {
+		var running, peak int32
+		jobs := make([]func(), 0)
+		for i := 0; i < 20; i++ {
+			jobs = append(jobs, func() {
+				current := atomic.AddInt32(&running, 1)
+				for {
+					seen := atomic.LoadInt32(&peak)
+					if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&running, -1)
+			})
+		}
+		runPool(3, jobs)
+		assert.Equal(t, int32(0), running)
+		assert.True(t, peak <= 3)
+
+		fake := &fakeProvider{}
+		hosts := make([]host.Host, 0)
+		for i := 0; i < 30; i++ {
+			name := "host-" + strconv.Itoa(i) + ".example.com"
+			hosts = append(hosts, host.Host{Name: name, Provider: "fake", Family: host.FamilyIPv4, Policy: host.PolicySingle})
+			if i%2 == 0 {
+				fake.add(provider.Record{Name: name, Content: "5.6.7.8"})
+			}
+		}
+		worker := Worker{
+			Providers:   map[string]provider.Provider{"fake": fake},
+			Hosts:       hosts,
+			Concurrency: 8,
+			CurrentIP:   net.ParseIP("1.2.3.4"),
+		}
+
+		report := newReport()
+		worker.getDNSRecords(report)
+		worker.checkHosts(report)
+
+		assert.Equal(t, 15, report.Fetched)
+		assert.Equal(t, 30, report.Applied)
+		assert.Equal(t, 0, report.Failed)
+		assert.Equal(t, 15, fake.created)
+		assert.Equal(t, 15, fake.updated)
+		for _, h := range hosts {
+			records := worker.HostMap[recordKey(h.Provider, h.Name, host.RecordTypeA)]
+			assert.Len(t, records, 1)
+			assert.Equal(t, "1.2.3.4", records[0].Content)
+		}
+	})
+
+	t.Run("report", func(t *testing.T) {
+		fake := &fakeProvider{}
+		fake.add(provider.Record{Content: "5.6.7.8"})
+		fake.add(provider.Record{Content: "9.9.9.9"})
+
+		h := host.Host{Name: "home.example.com", Provider: "fake", Family: host.FamilyIPv4, Policy: host.PolicySingle}
+		worker := Worker{
+			Providers: map[string]provider.Provider{"fake": fake},
+			Hosts:     []host.Host{h},
+			CurrentIP: net.ParseIP("1.2.3.4"),
+		}
+		worker.getDNSRecords(newReport())
+
+		changes := worker.plan()
+		changes[0].Refused = "not ours"
+		report := newReport()
+		worker.apply(changes, report)
+
+		assert.Equal(t, 0, report.Applied)
+		assert.Equal(t, 1, report.Refused)
+		assert.Equal(t, 1, report.Skipped)
+		assert.Equal(t, []string{
+			"refused: not ours",
+			"skipped delete of A record of host [home.example.com] after an earlier failure",
+		}, report.Errors)
+		assert.Equal(t, 0, fake.updated+fake.deleted)
+	})
+
+	t.Run("follow", func(t *testing.T) {
+		fake := &fakeProvider{}
+		fake.add(provider.Record{Name: "home.example.com", Content: "5.6.7.8"})
+		fake.add(provider.Record{Name: "www.example.com", Content: "5.6.7.8", Proxied: true})
+		fake.add(provider.Record{Name: "mail.example.com", Content: "5.6.7.8"})
+		fake.add(provider.Record{Name: "static.example.com", Content: "9.9.9.9"})
+		fake.add(provider.Record{Name: "vpn.internal.example.com", Content: "5.6.7.8"})
+
+		h := host.Host{Name: "home.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyIPv4, Policy: host.PolicySingle}
+		worker := Worker{
+			Providers: map[string]provider.Provider{host.ProviderCloudflare: fake},
+			Hosts:     []host.Host{h},
+			Follow:    Follow{Enabled: true, Zones: []string{"example.com"}, Exclude: []string{"*.internal.example.com"}},
+		}
+		worker.setCurrentIP(net.ParseIP("5.6.7.8"))
+		worker.getDNSRecords(newReport())
+		worker.setCurrentIP(net.ParseIP("1.2.3.4"))
+		assert.Equal(t, net.ParseIP("5.6.7.8"), worker.PreviousIP)
+
+		report := newReport()
+		worker.checkHosts(report)
+
+		assert.Equal(t, []string{"1.2.3.4", "1.2.3.4", "1.2.3.4", "9.9.9.9", "5.6.7.8"}, fake.contents())
+		assert.True(t, fake.records[1].Proxied)
+		assert.Equal(t, 3, report.Applied)
+		assert.Equal(t, []string{
+			"A mail.example.com [5.6.7.8] -> [1.2.3.4]",
+			"A www.example.com [5.6.7.8] -> [1.2.3.4]",
+		}, sortedCopy(report.Followed))
+		assert.Nil(t, worker.PreviousIP)
+
+		// the content of a managed record is not taken for a previous IP
+		fake.add(provider.Record{Name: "ftp.example.com", Content: "1.2.3.4"})
+		fake.add(provider.Record{Name: "typo.example.com", Content: "1.2.3.5"})
+		fake.records[0].Content = "1.2.3.5"
+		worker.getDNSRecords(newReport())
+		followChanges, complete := worker.planFollow(newReport())
+		assert.True(t, complete)
+		assert.Empty(t, followChanges)
+
+		// the state file tells the previous IP right after a restart
+		stateFile := filepath.Join(t.TempDir(), "state.json")
+		worker.Follow.StateFile = stateFile
+		assert.Nil(t, worker.checkHosts(newReport()))
+		state, err := ioutil.ReadFile(stateFile)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"":{"ipv4":"1.2.3.4"}}`, string(state))
+
+		worker = Worker{
+			Providers: map[string]provider.Provider{host.ProviderCloudflare: fake},
+			Hosts:     []host.Host{h},
+			Follow:    Follow{Enabled: true, Zones: []string{"example.com"}, StateFile: stateFile},
+			CurrentIP: net.ParseIP("4.3.2.1"),
+		}
+		worker.restorePreviousIPs()
+		assert.Equal(t, net.ParseIP("1.2.3.4"), worker.PreviousIP)
+		worker.getDNSRecords(newReport())
+
+		followChanges, complete = worker.planFollow(newReport())
+		assert.True(t, complete)
+		assert.Len(t, followChanges, 3)
+		for _, change := range followChanges {
+			assert.True(t, change.Followed)
+			assert.Equal(t, "4.3.2.1", change.NewContent)
+			assert.NotEqual(t, "home.example.com", change.Host)
+		}
+		assert.Nil(t, worker.checkHosts(newReport()))
+		state, err = ioutil.ReadFile(stateFile)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"":{"ipv4":"4.3.2.1"}}`, string(state))
+
+		_, err = getFollow()
+		assert.Nil(t, err)
+		viper.Set("cloudflare.follow.enabled", true)
+		viper.Set("cloudflare.follow.exclude", []string{"[a-"})
+		_, err = getFollow()
+		assert.NotNil(t, err)
+		assert.Equal(t, "invalid exclusion pattern for following the external IP: [[a-]", err.Error())
+		viper.Set("cloudflare.follow.enabled", false)
+		viper.Set("cloudflare.follow.exclude", []string{})
 	})
+
+	t.Run("quorum", func(t *testing.T) {
+		worker := Worker{
+			Resolvers: []resolver.Resolver{
+				staticResolver("first", "1.2.3.4"),
+				staticResolver("second", "1.2.3.4"),
+				staticResolver("third", "5.6.7.8"),
+				staticResolver("fourth", "5.6.7.8"),
+				staticResolver("fifth", "9.9.9.9"),
+				staticResolver("sixth", "5.6.7.8"),
+			},
+			Quorum: Quorum{Enabled: true, Size: 3, Min: 2},
+		}
+		assert.Nil(t, worker.checkQuorum())
+		assert.Equal(t, 2, worker.rounds())
+
+		err := worker.getExternalIP()
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("1.2.3.4"), worker.CurrentIP)
+		assert.Equal(t, map[string]int{"third": 1}, worker.Dissents)
+
+		err = worker.getExternalIP()
+		assert.Nil(t, err)
+		assert.Equal(t, net.ParseIP("5.6.7.8"), worker.CurrentIP)
+		assert.Equal(t, map[string]int{"third": 1, "fifth": 1}, worker.Dissents)
+
+		// no quorum keeps the current IP
+		worker.Quorum.Min = 3
+		err = worker.getExternalIP()
+		assert.Equal(t, resolver.ErrNoQuorum, err)
+		assert.Equal(t, net.ParseIP("5.6.7.8"), worker.CurrentIP)
+		assert.Nil(t, worker.check())
+
+		// resolvers cooling down do not vote
+		var up int32
+		cooling := Worker{
+			Resolvers: []resolver.Resolver{
+				flakyResolver("first", "1.2.3.4", &up),
+				staticResolver("second", "5.6.7.8"),
+				staticResolver("third", "5.6.7.8"),
+				staticResolver("fourth", "5.6.7.8"),
+			},
+			Quorum:  Quorum{Enabled: true, Size: 3, Min: 2},
+			Breaker: Breaker{Threshold: 1, CoolDown: time.Hour, MaxCoolDown: time.Hour},
+		}
+		assert.Nil(t, cooling.getExternalIP())
+		assert.Nil(t, cooling.getExternalIP())
+		assert.Equal(t, net.ParseIP("5.6.7.8"), cooling.CurrentIP)
+		assert.Equal(t, map[string]int{"first": 1}, cooling.Dissents)
+		health := cooling.ResolverHealth()
+		assert.Equal(t, 1, health["first"].Failures)
+		assert.Equal(t, 1, health["fourth"].Successes)
+
+		// each address family reaches its own quorum
+		ipv6Resolver := func(name string, body string) resolver.Resolver {
+			rslv := staticResolver(name, body)
+			rslv.Network = "tcp6"
+			return rslv
+		}
+		dual := Worker{
+			Hosts: []host.Host{{Name: "home.example.com", Family: host.FamilyDual}},
+			Resolvers: []resolver.Resolver{
+				staticResolver("first", "1.2.3.4"),
+				staticResolver("second", "1.2.3.4"),
+				ipv6Resolver("third", "2a00:1::1"),
+				ipv6Resolver("fourth", "2a00:1::2"),
+			},
+			Quorum:      Quorum{Enabled: true, Size: 2, Min: 2},
+			CurrentIPv6: net.ParseIP("2a00:1::3"),
+		}
+		assert.Nil(t, dual.getExternalIP())
+		assert.Equal(t, net.ParseIP("1.2.3.4"), dual.CurrentIP)
+		assert.Equal(t, net.ParseIP("2a00:1::3"), dual.CurrentIPv6)
+
+		dual.Resolvers[1] = staticResolver("second", "5.6.7.8")
+		assert.Equal(t, resolver.ErrNoQuorum, dual.getExternalIP())
+		assert.Equal(t, net.ParseIP("1.2.3.4"), dual.CurrentIP)
+
+		worker.Quorum.Size = 7
+		err = worker.checkQuorum()
+		assert.NotNil(t, err)
+		assert.Equal(t, "resolver quorum of [3] requires at least [7] resolvers, found [6]", err.Error())
+
+		viper.Set("resolver.quorum.enabled", true)
+		viper.Set("resolver.quorum.min", 4)
+		_, err = getQuorum()
+		assert.NotNil(t, err)
+		assert.Equal(t, "invalid resolver quorum: [4] out of [3]", err.Error())
+		viper.Set("resolver.quorum.enabled", false)
+		viper.Set("resolver.quorum.min", 2)
+	})
+
+	t.Run("health", func(t *testing.T) {
+		clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		now = func() time.Time { return clock }
+		defer func() { now = time.Now }()
+
+		var firstUp, secondUp int32 = 0, 1
+		worker := Worker{
+			Resolvers: []resolver.Resolver{
+				flakyResolver("first", "1.2.3.4", &firstUp),
+				flakyResolver("second", "5.6.7.8", &secondUp),
+			},
+			Breaker: Breaker{Threshold: 2, CoolDown: time.Minute, MaxCoolDown: 3 * time.Minute},
+		}
+
+		// the failing resolver falls through to the next one
+		assert.Nil(t, worker.getExternalIP())
+		assert.Equal(t, net.ParseIP("5.6.7.8"), worker.CurrentIP)
+		assert.Nil(t, worker.getExternalIP())
+		assert.Equal(t, 2, worker.Counter)
+
+		health := worker.ResolverHealth()
+		assert.Equal(t, 1, health["first"].Failures)
+		assert.Equal(t, "provider responded with HTTP/503", health["first"].LastError)
+		assert.False(t, health["first"].IsOpen())
+		assert.Equal(t, 2, health["second"].Successes)
+		assert.Equal(t, 1.0, health["second"].SuccessRate())
+
+		// the second failure in a row opens the circuit
+		assert.Nil(t, worker.getExternalIP())
+		health = worker.ResolverHealth()
+		assert.Equal(t, 2, health["first"].ConsecutiveFailures)
+		assert.Equal(t, 0.0, health["first"].SuccessRate())
+		assert.True(t, health["first"].IsOpen())
+		assert.Equal(t, clock.Add(time.Minute), health["first"].OpenUntil)
+
+		// the open circuit is skipped
+		worker.getExternalIP()
+		worker.getExternalIP()
+		assert.Equal(t, 2, worker.ResolverHealth()["first"].Failures)
+
+		// failing again after the cool down doubles it
+		clock = clock.Add(time.Minute)
+		worker.Counter = 0
+		assert.Nil(t, worker.getExternalIP())
+		health = worker.ResolverHealth()
+		assert.Equal(t, 3, health["first"].Failures)
+		assert.Equal(t, clock.Add(2*time.Minute), health["first"].OpenUntil)
+		assert.Equal(t, 3*time.Minute, worker.Breaker.coolDown(3))
+
+		// all resolvers down still asks the one whose turn it is
+		atomic.StoreInt32(&secondUp, 0)
+		for i := 0; i < 2; i++ {
+			worker.Counter = 1
+			assert.NotNil(t, worker.getExternalIP())
+		}
+		assert.True(t, worker.ResolverHealth()["second"].IsOpen())
+		worker.Counter = 0
+		err := worker.getExternalIP()
+		assert.NotNil(t, err)
+		assert.Equal(t, "provider responded with HTTP/503", err.Error())
+		health = worker.ResolverHealth()
+		assert.Equal(t, 4, health["first"].Failures)
+		assert.Equal(t, clock.Add(3*time.Minute), health["first"].OpenUntil)
+		assert.Equal(t, 2, health["second"].Failures)
+
+		// a success closes the circuit
+		atomic.StoreInt32(&firstUp, 1)
+		worker.Counter = 0
+		assert.Nil(t, worker.getExternalIP())
+		assert.Equal(t, net.ParseIP("1.2.3.4"), worker.CurrentIP)
+		health = worker.ResolverHealth()
+		assert.False(t, health["first"].IsOpen())
+		assert.Equal(t, 0, health["first"].ConsecutiveFailures)
+		assert.Equal(t, "success rate: 20%, latency: 0s, last error: provider responded with HTTP/503", health["first"].String())
+		worker.logStats()
+
+		worker.Resolvers = nil
+		err = worker.getExternalIP()
+		assert.NotNil(t, err)
+		assert.Equal(t, "no resolvers configured", err.Error())
+	})
+
+	t.Run("uplinks", func(t *testing.T) {
+		fake := &fakeProvider{}
+		fake.add(provider.Record{Name: "wan1.site.example.com", Content: "1.1.1.1"})
+		fake.add(provider.Record{Name: "wan2.site.example.com", Content: "2.2.2.1"})
+		fake.add(provider.Record{Name: "printer.site.example.com", Content: "2.2.2.1"})
+
+		hosts := []host.Host{
+			{Name: "home.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyIPv4, Policy: host.PolicySingle},
+			{Name: "wan1.site.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyIPv4, Policy: host.PolicySingle, Uplink: "wan1"},
+			{Name: "wan2.site.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyIPv4, Policy: host.PolicySingle, Uplink: "wan2"},
+		}
+		worker := Worker{
+			Providers: map[string]provider.Provider{host.ProviderCloudflare: fake},
+			Resolvers: []resolver.Resolver{staticResolver("default", "9.9.9.9")},
+			Uplinks: map[string]*Worker{
+				"wan1": {Resolvers: []resolver.Resolver{staticResolver("wan1-first", "1.1.1.1"), staticResolver("wan1-second", "1.1.1.1")}},
+				"wan2": {Resolvers: []resolver.Resolver{staticResolver("wan2", "2.2.2.2")}, CurrentIP: net.ParseIP("2.2.2.1")},
+			},
+			Hosts:       hosts,
+			Concurrency: 1,
+			Follow:      Follow{Enabled: true, Zones: []string{"example.com"}},
+		}
+		assert.Equal(t, 1, worker.minRounds())
+		assert.True(t, worker.rateLimited())
+
+		assert.Nil(t, worker.getExternalIP())
+		worker.getUplinkIPs()
+		assert.Equal(t, net.ParseIP("9.9.9.9"), worker.CurrentIP)
+		assert.Equal(t, net.ParseIP("1.1.1.1"), worker.Uplinks["wan1"].CurrentIP)
+		assert.Equal(t, net.ParseIP("2.2.2.2"), worker.Uplinks["wan2"].CurrentIP)
+		assert.Equal(t, net.ParseIP("2.2.2.1"), worker.Uplinks["wan2"].PreviousIP)
+
+		// each host publishes the IP of its uplink, and records following the
+		// previous IP of an uplink move along with it
+		worker.getDNSRecords(newReport())
+		changes := worker.plan()
+		followChanges, complete := worker.planFollow(newReport())
+		assert.True(t, complete)
+		assert.Len(t, changes, 2)
+		assert.Equal(t, ActionCreate, changes[0].Action)
+		assert.Equal(t, "home.example.com", changes[0].Host)
+		assert.Equal(t, "9.9.9.9", changes[0].NewContent)
+		assert.Equal(t, ActionUpdate, changes[1].Action)
+		assert.Equal(t, "wan2.site.example.com", changes[1].Host)
+		assert.Equal(t, "2.2.2.2", changes[1].NewContent)
+		assert.Len(t, followChanges, 1)
+		assert.Equal(t, "printer.site.example.com", followChanges[0].Host)
+		assert.Equal(t, "2.2.2.2", followChanges[0].NewContent)
+
+		assert.Nil(t, worker.checkHosts(newReport()))
+		assert.Nil(t, worker.Uplinks["wan2"].PreviousIP)
+		assert.ElementsMatch(t, []string{"1.1.1.1", "2.2.2.2", "2.2.2.2", "9.9.9.9"}, fake.contents())
+		health := worker.ResolverHealth()
+		assert.Len(t, health, 4)
+		assert.Equal(t, 1, health["wan2/wan2"].Successes)
+
+		// uplinks alone refresh the records once per round of the fastest one
+		only := Worker{
+			Uplinks: map[string]*Worker{
+				"wan1": {Resolvers: []resolver.Resolver{staticResolver("ipify", "1.1.1.1"), staticResolver("second", "1.1.1.1")}},
+				"wan2": {Resolvers: []resolver.Resolver{staticResolver("ipify", "2.2.2.2"), staticResolver("second", "2.2.2.2"), staticResolver("third", "2.2.2.2")}},
+			},
+		}
+		assert.Equal(t, 2, only.minRounds())
+		assert.Equal(t, []bool{false, true, false, true}, []bool{only.refreshDue(), only.refreshDue(), only.refreshDue(), only.refreshDue()})
+		only.getUplinkIPs()
+		health = only.ResolverHealth()
+		assert.Equal(t, 1, health["wan1/ipify"].Successes)
+		assert.Equal(t, 1, health["wan2/ipify"].Successes)
+
+		// hosts must be bound to a configured uplink
+		defer viper.Set("uplinks", nil)
+		viper.Set("uplinks", []map[string]interface{}{
+			{"name": "wan1", "resolvers": []map[string]interface{}{{"name": "wan1-ipify", "type": "text", "url": "https://api.ipify.org", "bindAddress": "192.0.2.10"}}},
+		})
+		err := worker.initUplinks()
+		assert.NotNil(t, err)
+		assert.Equal(t, "host [wan2.site.example.com] is bound to unknown uplink [wan2]", err.Error())
+
+		worker.Hosts = hosts[:2]
+		assert.Nil(t, worker.initUplinks())
+		assert.Len(t, worker.Uplinks, 1)
+		assert.Equal(t, []host.Host{hosts[1]}, worker.Uplinks["wan1"].Hosts)
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		validation, err := getValidation()
+		assert.Nil(t, err)
+		assert.True(t, validation.Enabled)
+		assert.Equal(t, "a private address", validation.reject(net.ParseIP("10.0.0.1")))
+		assert.Equal(t, "a CGNAT address", validation.reject(net.ParseIP("100.64.1.2")))
+		assert.Equal(t, "a loopback address", validation.reject(net.ParseIP("::1")))
+		assert.Equal(t, "a link-local address", validation.reject(net.ParseIP("169.254.1.1")))
+		assert.Equal(t, "a documentation address", validation.reject(net.ParseIP("2001:db8::1")))
+		assert.Equal(t, "a multicast address", validation.reject(net.ParseIP("239.1.1.1")))
+		assert.Equal(t, "", validation.reject(net.ParseIP("1.2.3.4")))
+		assert.Equal(t, "", Validation{}.reject(net.ParseIP("10.0.0.1")))
+
+		defer viper.Set("resolver.validation.allow", nil)
+		defer viper.Set("resolver.validation.deny", nil)
+		viper.Set("resolver.validation.allow", []string{"10.1.0.0/16"})
+		viper.Set("resolver.validation.deny", []string{"5.6.7.0/24", "10.1.2.3"})
+		validation, err = getValidation()
+		assert.Nil(t, err)
+		assert.Equal(t, "", validation.reject(net.ParseIP("10.1.0.1")))
+		assert.Equal(t, "in the denied network [10.1.2.3/32]", validation.reject(net.ParseIP("10.1.2.3")))
+		assert.Equal(t, "in the denied network [5.6.7.0/24]", validation.reject(net.ParseIP("5.6.7.8")))
+
+		viper.Set("resolver.validation.deny", []string{"5.6.7.0/33"})
+		_, err = getValidation()
+		assert.NotNil(t, err)
+		assert.Equal(t, "resolver validation: invalid network: [5.6.7.0/33]", err.Error())
+
+		// a rejected answer counts as a failure, and the next resolver is asked
+		worker := Worker{
+			Resolvers: []resolver.Resolver{
+				staticResolver("portal", "10.0.0.1"),
+				staticResolver("good", "1.2.3.4"),
+			},
+			Validation: Validation{Enabled: true},
+		}
+		assert.Nil(t, worker.getExternalIP())
+		assert.Equal(t, net.ParseIP("1.2.3.4"), worker.CurrentIP)
+		health := worker.ResolverHealth()
+		assert.Equal(t, 1, health["portal"].Failures)
+		assert.Equal(t, "resolver [portal] answered [10.0.0.1], a private address", health["portal"].LastError)
+
+		// the votes of the quorum are validated as well
+		worker = Worker{
+			Resolvers: []resolver.Resolver{
+				staticResolver("first", "100.64.0.5"),
+				staticResolver("second", "100.64.0.5"),
+			},
+			Quorum:     Quorum{Enabled: true, Size: 2, Min: 2},
+			Validation: Validation{Enabled: true},
+		}
+		err = worker.getExternalIP()
+		assert.Equal(t, resolver.ErrNoQuorum, err)
+		assert.Nil(t, worker.CurrentIP)
+		health = worker.ResolverHealth()
+		assert.Equal(t, "resolver [first] answered [100.64.0.5], a CGNAT address", health["first"].LastError)
+
+		// hosts only publish the IPs they permit
+		fake := &fakeProvider{}
+		worker = Worker{
+			Providers: map[string]provider.Provider{"fake": fake},
+			Hosts: []host.Host{
+				{Name: "allowed.example.com", Provider: "fake", Family: host.FamilyIPv4, Policy: host.PolicySingle, Allow: networks("1.2.3.0/24")},
+				{Name: "denied.example.com", Provider: "fake", Family: host.FamilyIPv4, Policy: host.PolicySingle, Deny: networks("1.2.0.0/16")},
+				{Name: "elsewhere.example.com", Provider: "fake", Family: host.FamilyIPv4, Policy: host.PolicySingle, Allow: networks("5.6.7.0/24")},
+			},
+			CurrentIP: net.ParseIP("1.2.3.4"),
+		}
+		worker.getDNSRecords(newReport())
+		changes := worker.plan()
+		assert.Len(t, changes, 1)
+		assert.Equal(t, "allowed.example.com", changes[0].Host)
+	})
+
+	t.Run("prefixDelegation", func(t *testing.T) {
+		assert.Equal(t, net.ParseIP("2a00:1:2:3401::10"), withSuffix(net.ParseIP("2a00:1:2:3400::abcd"), net.ParseIP("0:0:0:1::10"), 56))
+		assert.Equal(t, net.ParseIP("2a00:1:2:3400::1:10"), withSuffix(net.ParseIP("2a00:1:2:3400::abcd"), net.ParseIP("::1:10"), 64))
+		assert.Equal(t, net.ParseIP("2a00:1:2:3400::1:10"), withSuffix(net.ParseIP("2a00:1:2:3400::abcd"), net.ParseIP("2001:db8::1:10"), 64))
+
+		length, err := getPrefixLength()
+		assert.Nil(t, err)
+		assert.Equal(t, 64, length)
+		defer viper.Set("resolver.prefixLength", 64)
+		viper.Set("resolver.prefixLength", 129)
+		_, err = getPrefixLength()
+		assert.NotNil(t, err)
+		assert.Equal(t, "invalid delegated IPv6 prefix length: [129]", err.Error())
+
+		fake := &fakeProvider{}
+		fake.add(provider.Record{Name: "printer.example.com", Type: host.RecordTypeAAAA, Content: "2a00:1:2:3401::20"})
+		worker := Worker{
+			Providers: map[string]provider.Provider{host.ProviderCloudflare: fake},
+			Hosts: []host.Host{
+				{Name: "router.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyIPv6, Policy: host.PolicySingle},
+				{Name: "nas.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyIPv6, Policy: host.PolicySingle, Suffix: "0:0:0:1::10"},
+				{Name: "www.example.com", Provider: host.ProviderCloudflare, Family: host.FamilyDual, Policy: host.PolicySingle, Suffix: "0:0:0:1::80"},
+			},
+			PrefixLength: 56,
+			Concurrency:  1,
+			CurrentIP:    net.ParseIP("1.2.3.4"),
+			CurrentIPv6:  net.ParseIP("2a00:1:2:3400::1"),
+			Follow:       Follow{Enabled: true, Zones: []string{"example.com"}},
+		}
+		worker.getDNSRecords(newReport())
+		assert.Nil(t, worker.checkHosts(newReport()))
+		assert.ElementsMatch(t, []string{"2a00:1:2:3401::20", "2a00:1:2:3400::1", "2a00:1:2:3401::10", "1.2.3.4", "2a00:1:2:3401::80"}, fake.contents())
+
+		// a new delegated prefix moves all hosts along, and the records
+		// following their previous addresses with them
+		worker.setCurrentIP(net.ParseIP("2a00:1:2:5600::1"))
+		fake.add(provider.Record{Name: "intranet.example.com", Type: host.RecordTypeAAAA, Content: "2a00:1:2:3401::10"})
+		worker.getDNSRecords(newReport())
+		changes := worker.plan()
+		assert.Len(t, changes, 3)
+		for _, change := range changes {
+			assert.Equal(t, ActionUpdate, change.Action)
+		}
+		followChanges, _ := worker.planFollow(newReport())
+		assert.Len(t, followChanges, 1)
+		assert.Equal(t, "intranet.example.com", followChanges[0].Host)
+		assert.Equal(t, "2a00:1:2:5601::10", followChanges[0].NewContent)
+
+		assert.Nil(t, worker.checkHosts(newReport()))
+		assert.ElementsMatch(t, []string{"2a00:1:2:3401::20", "2a00:1:2:5600::1", "2a00:1:2:5601::10", "1.2.3.4", "2a00:1:2:5601::80", "2a00:1:2:5601::10"}, fake.contents())
+	})
+
+	t.Run("natWarnings", func(t *testing.T) {
+		worker := Worker{CurrentIP: net.ParseIP("1.2.3.4"), CurrentIPv6: net.ParseIP("2a00:1::1")}
+		assert.Empty(t, worker.natWarnings(map[string][]net.IP{
+			"eth0": {net.ParseIP("192.168.1.10"), net.ParseIP("2a00:1::1"), net.ParseIP("fe80::1")},
+		}))
+		assert.Equal(t, []string{
+			"interface [wwan0] has the carrier-grade NAT address [100.64.3.4]",
+		}, worker.natWarnings(map[string][]net.IP{
+			"lo":    {net.ParseIP("127.0.0.1")},
+			"wwan0": {net.ParseIP("100.64.3.4")},
+		}))
+		assert.Equal(t, []string{
+			"the external IP [1.2.3.4] is none of the public addresses [5.6.7.8] of the network interfaces",
+			"the external IP [2a00:1::1] is none of the public addresses [2a00:2::1, 2a00:2::2] of the network interfaces",
+		}, worker.natWarnings(map[string][]net.IP{
+			"eth0": {net.ParseIP("5.6.7.8"), net.ParseIP("2a00:2::1")},
+			"eth1": {net.ParseIP("2a00:2::2")},
+		}))
+
+		// the external IPs of several uplinks are not compared
+		worker.Uplinks = map[string]*Worker{"wan1": {CurrentIP: net.ParseIP("9.9.9.9")}}
+		assert.Empty(t, worker.natWarnings(map[string][]net.IP{"eth0": {net.ParseIP("5.6.7.8")}}))
+
+		// the interfaces are only looked at again once the external IPs change
+		defer func(original func() (map[string][]net.IP, error)) { localAddrs = original }(localAddrs)
+		calls := 0
+		localAddrs = func() (map[string][]net.IP, error) {
+			calls++
+			return map[string][]net.IP{"wwan0": {net.ParseIP("100.64.3.4")}}, nil
+		}
+		worker.checkNAT()
+		worker.checkNAT()
+		assert.Equal(t, 1, calls)
+		worker.Uplinks["wan1"].setCurrentIP(net.ParseIP("9.9.9.10"))
+		worker.checkNAT()
+		assert.Equal(t, 2, calls)
+	})
+}
+
+// networks parses networks known to be valid
+func networks(cidrs ...string) []*net.IPNet {
+	result, _ := config.Networks(cidrs)
+	return result
+}
+
+func sortedCopy(values []string) []string {
+	result := append([]string{}, values...)
+	sort.Strings(result)
+	return result
 }